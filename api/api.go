@@ -2,173 +2,29 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/base64"
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"slices"
+	"sort"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/csmanutd/s3utils" // Import the s3utils package
 
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
 	"github.com/csmanutd/csutils"
 )
 
-// LoadConfig read config from json file
-func LoadConfig(fileName string) (csutils.CloudSecureConfig, error) {
-	return csutils.LoadOrCreateCloudSecureConfig(fileName)
-}
-
-// SaveConfig save config to json file
-func SaveConfig(fileName string, config csutils.CloudSecureConfig) error {
-	return csutils.SaveCloudSecureConfig(fileName, config)
-}
-
 // PromptUserInput prompt user to input API credentials and tenant ID
 func PromptUserInput() csutils.CloudSecureInfo {
 	return csutils.CreateNewCloudSecureInfo()
 }
 
-func createFlowReport(apiKey, apiSecret, tenantID, fileName, fileFormat, fromTime, toTime string, maxResults int) ([]map[string]interface{}, error) {
-	url := "https://cloud.illum.io/api/v1/flows"
-
-	// Encode the API key and secret
-	credentials := fmt.Sprintf("%s:%s", apiKey, apiSecret)
-	encodedCredentials := base64.StdEncoding.EncodeToString([]byte(credentials))
-
-	headers := map[string]string{
-		"accept":        "*/*",
-		"content-type":  "application/json",
-		"Authorization": "Basic " + encodedCredentials,
-		"x-tenant-id":   tenantID,
-	}
-
-	data := map[string]interface{}{
-		"fileName":   fileName,
-		"fileFormat": "FILE_FORMAT_" + strings.ToUpper(fileFormat),
-		"period": map[string]string{
-			"start_time": fromTime,
-			"end_time":   toTime,
-		},
-		"max_results": maxResults,
-	}
-
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling data: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
-
-	for key, value := range headers {
-		req.Header.Set(key, value)
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with status code: %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body) // use io package's ReadAll function
-	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
-	}
-
-	// Parse the response as JSON
-	var jsonResponse map[string]interface{}
-	err = json.Unmarshal(body, &jsonResponse)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %v", err)
-	}
-
-	// Extract the "flows" part of the response
-	flows, ok := jsonResponse["flows"].([]interface{})
-	if !ok || len(flows) == 0 {
-		return nil, fmt.Errorf("no flows data found in the response")
-	}
-
-	// Convert flows to a slice of maps
-	result := make([]map[string]interface{}, len(flows))
-	for i, flow := range flows {
-		result[i] = flow.(map[string]interface{})
-	}
-
-	return result, nil
-}
-
-func writeCSV(fileName string, data []map[string]interface{}, appendMode bool) error {
-	// Fixed header order and new names
-	headersList := []string{"FlowStatus", "FirstDetected", "LastDetected", "Source_IP", "Destination_IP", "DestinationPort", "Protocol", "ByteCount"}
-	originalHeaders := []string{"status", "start_time", "end_time", "src", "dst", "dst_port", "protocol", "bytes"}
-
-	// Open the CSV file with append mode if necessary
-	fileMode := os.O_CREATE | os.O_WRONLY
-	if appendMode {
-		fileMode |= os.O_APPEND
-	}
-
-	file, err := os.OpenFile(fileName, fileMode, 0644)
-	if err != nil {
-		return fmt.Errorf("error creating/opening file: %v", err)
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write the header to the CSV file only if not in append mode
-	if !appendMode {
-		if err := writer.Write(headersList); err != nil {
-			return fmt.Errorf("error writing CSV header: %v", err)
-		}
-	}
-
-	// Regular expression to extract the IP address
-	re := regexp.MustCompile(`ip_address:([\d\.]+)`)
-
-	// Write the values to the CSV file
-	for _, flowMap := range data {
-		record := make([]string, len(headersList))
-		for i, originalHeader := range originalHeaders {
-			value := flowMap[originalHeader]
-			valueStr := fmt.Sprintf("%v", value)
-
-			// Clean up Source_IP and Destination_IP columns
-			if originalHeader == "src" || originalHeader == "dst" {
-				matches := re.FindStringSubmatch(valueStr)
-				if len(matches) > 1 {
-					valueStr = matches[1]
-				} else {
-					valueStr = ""
-				}
-			}
-
-			record[i] = valueStr
-		}
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("error writing CSV record: %v", err)
-		}
-	}
-
-	return nil
-}
-
 // S3Config represents the S3 configuration
 type S3Config struct {
 	BucketName  string `json:"bucket_name"`
@@ -197,197 +53,592 @@ func SaveS3Config(fileName string, config S3Config) error {
 	return os.WriteFile(fileName, data, 0644)
 }
 
-// add retry function
-func withRetry(operation func() ([]map[string]interface{}, error), maxRetries int) ([]map[string]interface{}, error) {
-	var lastErr error
-	for i := 0; i < maxRetries; i++ {
-		if i > 0 {
-			waitTime := time.Duration(i) * 2 * time.Second
-			fmt.Printf("Retry attempt %d after %v\n", i, waitTime)
-			time.Sleep(waitTime)
-		}
+func main() {
+	const configFileName = "csconfig.json"
 
-		result, err := operation()
-		if err == nil {
-			return result, nil
+	if len(os.Args) > 1 && os.Args[1] == "fake-cloudsecure" {
+		if err := runFakeServer(os.Args[2:]); err != nil {
+			fmt.Printf("Fake CloudSecure failed: %v\n", err)
+			os.Exit(1)
 		}
-		lastErr = err
-		fmt.Printf("Attempt %d failed: %v\n", i+1, err)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Args[2:], configFileName); err != nil {
+			fmt.Printf("Config failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := runServe(os.Args[2:], configFileName); err != nil {
+			fmt.Printf("Serve failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	return nil, fmt.Errorf("all %d attempts failed, last error: %v", maxRetries, lastErr)
-}
-
-// add SegmentResult struct
-type SegmentResult struct {
-	Error error
-	Index int
-}
-
-// add global mutex lock
-var mu sync.Mutex
-
-func main() {
-	const configFileName = "csconfig.json"
 
 	// add command line options
-	csName := flag.String("cs", "", "Specify CloudSecure name")
-	outputFile := flag.String("out", "", "Specify output CSV file name")
+	csName := flag.String("cs", "", "Specify CloudSecure name, a comma separated list of names, or all")
+	combined := flag.Bool("combined", false, "With several tenants, write one file per day with a Tenant column instead of one file per tenant")
+	outputFile := flag.String("out", "", "Specify output file name")
+	allFields := flag.Bool("all-fields", false, "Write every field returned by the API, with nested objects flattened into dotted column names")
+	enrich := flag.Bool("enrich", false, "Add the workload, labels, VPC and account of both endpoints as Source_* and Dest_* columns")
+	dedup := flag.Bool("dedup", false, "Write flows returned by more than one segment only once")
+	dedupKey := flag.String("dedup-key", strings.Join(cloudsecure.DefaultDedupKey, ","), "Fields identifying a flow for -dedup, comma separated: "+
+		"src, dst, dst_port, protocol, start_time, end_time, status, bytes, or dotted paths in the flow JSON")
+	aggregate := flag.Bool("aggregate", false, "Write one row per group and time bucket with summed bytes instead of every flow")
+	groupBy := flag.String("group-by", strings.Join(cloudsecure.DefaultAggregateKey, ","), "Fields grouped by with -aggregate, comma separated, named as in -dedup-key")
+	bucket := flag.String("bucket", cloudsecure.BucketDay, "Time bucket of -aggregate: "+strings.Join(cloudsecure.AggregateBuckets, ", "))
+	columnsFile := flag.String("columns", "", "JSON file with the output columns, replacing the columns in csconfig.json")
+	format := flag.String("format", "csv", "Output format: "+strings.Join(cloudsecure.Formats, ", "))
+	compress := flag.String("compress", "", "Compress the output files: "+strings.Join(cloudsecure.Compressions, ", "))
 	noS3Upload := flag.Bool("nos3", false, "Skip uploading to S3 bucket")
+	dateFlag := flag.String("date", "", "Retrieve a single day (YYYYMMDD)")
+	fromFlag := flag.String("from", "", "First day of the range to retrieve (YYYYMMDD)")
+	toFlag := flag.String("to", "", "Last day of the range to retrieve, inclusive (YYYYMMDD), defaults to yesterday")
+	lastDays := flag.Int("last", 0, "Retrieve the last N days, ending yesterday")
+	follow := flag.Bool("follow", false, "Keep running and append new flows to hourly files every -poll")
+	pollInterval := flag.Duration("poll", 5*time.Minute, "Time between polls with -follow")
+	pollLag := flag.Duration("lag", time.Minute, "How far behind the current time -follow stays, for flows reported late")
+	stateFile := flag.String("state", "follow.state.json", "File keeping the -follow watermark of every tenant")
+	resume := flag.Bool("resume", false, "Fetch only the segments missing from a previous failed run")
+	defaultSegments := cloudsecure.DefaultSegmentOptions()
+	maxResults := flag.Int("max-results", defaultSegments.MaxResults, "Maximum number of flows requested per segment")
+	segmentSize := flag.Duration("segment", defaultSegments.Initial, "Initial time segment size")
+	minSegment := flag.Duration("min-segment", defaultSegments.Min, "Smallest segment a truncated segment is split into")
+	maxSegment := flag.Duration("max-segment", defaultSegments.Max, "Largest segment used on quiet days")
+	timeout := flag.Duration("timeout", 0, "Overall time limit for the run, 0 for none")
+	requestTimeout := flag.Duration("request-timeout", 30*time.Minute, "Time limit for each API request, including reading the response, 0 for none")
+	defaultRetry := cloudsecure.DefaultRetryPolicy()
+	retryAttempts := flag.Int("retry-attempts", defaultRetry.MaxAttempts, "Maximum attempts per request, including the first")
+	retryBackoff := flag.Duration("retry-backoff", defaultRetry.InitialBackoff, "Wait after the first failed attempt, doubled after each further failure")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", defaultRetry.MaxBackoff, "Longest wait between attempts")
+	retryMaxElapsed := flag.Duration("retry-max-elapsed", defaultRetry.MaxElapsed, "Stop retrying a request after this long, 0 for no limit")
+	concurrency := flag.Int("concurrency", 2, "Number of segments fetched at the same time")
+	rateLimit := flag.Float64("rpm", 0, "Maximum API requests per minute across all tenants, 0 for the rate_limit in csconfig.json or no limit")
+	rateBurst := flag.Int("rate-burst", 1, "Number of requests that may be sent at once under -rpm")
+	statusFilter := flag.String("status", "", "Only keep flows with these statuses, comma separated (e.g. ALLOWED)")
+	srcCIDRs := flag.String("src-cidr", "", "Only keep flows from these IPs or CIDRs, comma separated")
+	dstCIDRs := flag.String("dst-cidr", "", "Only keep flows to these IPs or CIDRs, comma separated")
+	excludeSrcCIDRs := flag.String("exclude-src-cidr", "", "Skip flows from these IPs or CIDRs, comma separated")
+	excludeDstCIDRs := flag.String("exclude-dst-cidr", "", "Skip flows to these IPs or CIDRs, comma separated")
+	portFilter := flag.String("port", "", "Only keep flows to these destination ports, comma separated")
+	protocolFilter := flag.String("protocol", "", "Only keep flows with these protocols, comma separated (e.g. TCP,UDP)")
+	presetName := flag.String("preset", "", "Build the flow filter from this filter_cli preset")
+	presetsFile := flag.String("presets", "presets.json", "filter_cli presets file used by -preset")
+	nonInteractive := flag.Bool("non-interactive", false, "Fail instead of prompting for credentials, tenants or the date; the date defaults to yesterday")
+	configKeyFile := flag.String("config-key-file", "", "Key file of an encrypted csconfig.json, defaults to CS_CONFIG_KEY_FILE")
+	secretsDir := flag.String("secrets-dir", secretsDirDefault(), "Directory of secret files, <dir>/<tenant>/api_key, api_secret and tenant_id")
+	useKeyring := flag.Bool("keyring", true, "Look up credentials in the OS keyring with secret-tool or security")
+	baseURL := flag.String("base-url", "", "CloudSecure API base URL for all tenants, e.g. http://127.0.0.1:8080 for fake-cloudsecure")
 	flag.Parse()
 
-	// Load configuration
-	config, err := LoadConfig(configFileName)
+	if *concurrency < 1 {
+		fmt.Println("-concurrency must be at least 1")
+		os.Exit(1)
+	}
+	if !slices.Contains(cloudsecure.Formats, *format) {
+		fmt.Printf("Unknown format %q, expected one of %s\n", *format, strings.Join(cloudsecure.Formats, ", "))
+		os.Exit(1)
+	}
+	if *compress != "" {
+		if err := cloudsecure.CheckCompression(*compress); err != nil {
+			fmt.Printf("Invalid compression: %v\n", err)
+			os.Exit(1)
+		}
+		switch {
+		case *format == "parquet":
+			fmt.Println("Parquet files are compressed already and cannot be combined with -compress")
+			os.Exit(1)
+		}
+		// -out names the compressed file
+		if *outputFile != "" && !strings.HasSuffix(*outputFile, cloudsecure.CompressionExtension(*compress)) {
+			*outputFile += cloudsecure.CompressionExtension(*compress)
+		}
+	}
+	if *follow {
+		switch {
+		case !slices.Contains(cloudsecure.AppendFormats, *format):
+			fmt.Printf("-follow appends to its files and needs -format %s\n", strings.Join(cloudsecure.AppendFormats, " or "))
+			os.Exit(1)
+		case *allFields || *aggregate || *combined || *resume:
+			fmt.Println("-follow cannot be combined with -all-fields, -aggregate, -combined or -resume")
+			os.Exit(1)
+		case *pollInterval <= 0:
+			fmt.Println("-poll must be positive")
+			os.Exit(1)
+		}
+	}
+
+	segOpts := cloudsecure.SegmentOptions{
+		MaxResults: *maxResults,
+		Initial:    *segmentSize,
+		Min:        *minSegment,
+		Max:        *maxSegment,
+		Logf:       printLine,
+	}
+	if err := segOpts.Validate(); err != nil {
+		fmt.Printf("Invalid segment options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Flow filter: the preset first, then any filter flags replace its fields
+	filter := &cloudsecure.FlowFilter{}
+	if *presetName != "" {
+		var err error
+		filter, err = presetFilter(*presetsFile, *presetName)
+		if err != nil {
+			fmt.Printf("Error loading preset: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var filterErr error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "status":
+			filter.Statuses = splitList(*statusFilter)
+		case "src-cidr":
+			filter.SrcCIDRs = splitList(*srcCIDRs)
+		case "dst-cidr":
+			filter.DstCIDRs = splitList(*dstCIDRs)
+		case "exclude-src-cidr":
+			filter.ExcludeSrcCIDRs = splitList(*excludeSrcCIDRs)
+		case "exclude-dst-cidr":
+			filter.ExcludeDstCIDRs = splitList(*excludeDstCIDRs)
+		case "port":
+			filter.Ports, filterErr = parsePorts(*portFilter)
+		case "protocol":
+			filter.Protocols = splitList(*protocolFilter)
+		}
+	})
+	if filterErr == nil {
+		filterErr = filter.Normalize()
+	}
+	if filterErr != nil {
+		fmt.Printf("Invalid filter: %v\n", filterErr)
+		os.Exit(1)
+	}
+	if !filter.IsEmpty() {
+		data, _ := json.Marshal(filter)
+		fmt.Printf("Flow filter: %s\n", data)
+	}
+
+	// Load configuration; credentials come from the environment, secret files
+	// and the OS keyring first, then csconfig.json
+	config, err := LoadConfig(configFileName, configKeyFromEnv(*configKeyFile, !*nonInteractive))
+	configMissing := os.IsNotExist(err)
+	if err != nil && !configMissing {
+		// never replace a config that could not be read or decrypted
+		fmt.Printf("Error loading %s: %v\n", configFileName, err)
+		os.Exit(1)
+	}
+	if config.CloudSecures == nil {
+		config.CloudSecures = make(map[string]csutils.CloudSecureInfo)
+	}
+	credentials, err := resolveConfig(config, *secretsDir, *useKeyring, splitList(*csName))
 	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if configMissing && len(credentials.CloudSecures) == 0 {
+		if *nonInteractive {
+			fmt.Printf("No CloudSecure credentials found in %s, the environment, %s or the keyring\n", configFileName, *secretsDir)
+			os.Exit(1)
+		}
 		fmt.Println("Config file not found. Please enter your API credentials.")
-		config.CloudSecures = make(map[string]csutils.CloudSecureInfo)
-		config.DefaultCloudName = addNewCloudSecure(&config)
-		SaveConfig(configFileName, config)
+		config.DefaultCloudName = addNewCloudSecure(&config.CloudSecureConfig)
+		if err := SaveConfig(configFileName, config); err != nil {
+			fmt.Printf("Error saving %s: %v\n", configFileName, err)
+			os.Exit(1)
+		}
 		fmt.Println("Config file saved.")
+		credentials, err = resolveConfig(config, *secretsDir, *useKeyring, splitList(*csName))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 
 	// Determine which CloudSecure to use
-	selectedCS := config.DefaultCloudName
-	if *csName != "" {
-		selectedCS = *csName
-	}
-
-	// Check if the specified CloudSecure exists
-	for {
-		if _, exists := config.CloudSecures[selectedCS]; !exists {
-			fmt.Printf("CloudSecure '%s' not found. Add a new tenant? (Y/n): ", selectedCS)
-			reader := bufio.NewReader(os.Stdin)
-			response, _ := reader.ReadString('\n')
-			response = strings.TrimSpace(strings.ToLower(response))
+	var selectedTenants []string
+	if *csName == "all" || strings.Contains(*csName, ",") {
+		selectedTenants, err = selectTenants(*csName, credentials)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		selectedCS := credentials.DefaultCloudName
+		if *csName != "" {
+			selectedCS = *csName
+		}
 
-			if response == "" || response == "y" {
-				selectedCS = addNewCloudSecure(&config)
-				SaveConfig(configFileName, config)
+		// Check if the specified CloudSecure exists
+		for {
+			if _, exists := credentials.CloudSecures[selectedCS]; !exists {
+				if *nonInteractive {
+					fmt.Printf("CloudSecure '%s' not found\n", selectedCS)
+					os.Exit(1)
+				}
+				fmt.Printf("CloudSecure '%s' not found. Add a new tenant? (Y/n): ", selectedCS)
+				reader := bufio.NewReader(os.Stdin)
+				response, _ := reader.ReadString('\n')
+				response = strings.TrimSpace(strings.ToLower(response))
+
+				if response == "" || response == "y" {
+					selectedCS = addNewCloudSecure(&config.CloudSecureConfig)
+					if err := SaveConfig(configFileName, config); err != nil {
+						fmt.Printf("Error saving %s: %v\n", configFileName, err)
+						os.Exit(1)
+					}
+				} else {
+					fmt.Print("Enter CloudSecure name: ")
+					selectedCS, _ = reader.ReadString('\n')
+					selectedCS = strings.TrimSpace(selectedCS)
+				}
+				credentials, err = resolveConfig(config, *secretsDir, *useKeyring, []string{selectedCS})
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
 			} else {
-				fmt.Print("Enter CloudSecure name: ")
-				selectedCS, _ = reader.ReadString('\n')
-				selectedCS = strings.TrimSpace(selectedCS)
+				break
 			}
-		} else {
-			break
+		}
+		selectedTenants = []string{selectedCS}
+	}
+	for _, tenant := range selectedTenants {
+		if missing := missingCredentials(credentials.CloudSecures[tenant]); len(missing) > 0 {
+			var names []string
+			for _, field := range missing {
+				names = append(names, envName(tenant, field))
+			}
+			fmt.Printf("CloudSecure '%s' is missing %s: set %s, add secret files to %s or add them to %s\n",
+				tenant, strings.Join(missing, ", "), strings.Join(names, ", "), *secretsDir, configFileName)
+			os.Exit(1)
 		}
 	}
 
-	fmt.Printf("Using CloudSecure: %s\n", selectedCS)
+	fmt.Printf("Using CloudSecure: %s\n", strings.Join(selectedTenants, ", "))
 
-	// Prompt user for date input
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter the date (YYYYMMDD) to retrieve data (leave empty for yesterday): ")
-	dateInput, _ := reader.ReadString('\n')
-	dateInput = strings.TrimSpace(dateInput)
-
-	// If no date is provided, use the previous day
-	var date time.Time
-	if dateInput == "" {
-		date = time.Now().AddDate(0, 0, -1)
-		dateInput = date.Format("20060102")
-	} else {
-		date, err = time.Parse("20060102", dateInput)
+	// Work out which days to retrieve; the prompt is only used when no date flag is given
+	var dates []time.Time
+	if !*follow {
+		if *dateFlag == "" && *fromFlag == "" && *toFlag == "" && *lastDays == 0 && !*nonInteractive {
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter the date (YYYYMMDD) to retrieve data (leave empty for yesterday): ")
+			dateInput, _ := reader.ReadString('\n')
+			*dateFlag = strings.TrimSpace(dateInput)
+		}
+		dates, err = parseDateRange(*dateFlag, *fromFlag, *toFlag, *lastDays, time.Now())
 		if err != nil {
-			fmt.Printf("Invalid date format: %v\n", err)
+			fmt.Printf("Invalid date selection: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	// Set default output file name if not specified
-	if *outputFile == "" {
-		*outputFile = dateInput + ".csv"
-	}
-
-	// modify time segments definition to 12 segments
-	timeSegments := []struct {
-		fromTime string
-		toTime   string
-	}{
-		{fromTime: date.Add(22 * time.Hour).Format(time.RFC3339), toTime: date.Add(24 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(20 * time.Hour).Format(time.RFC3339), toTime: date.Add(22 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(18 * time.Hour).Format(time.RFC3339), toTime: date.Add(20 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(16 * time.Hour).Format(time.RFC3339), toTime: date.Add(18 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(14 * time.Hour).Format(time.RFC3339), toTime: date.Add(16 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(12 * time.Hour).Format(time.RFC3339), toTime: date.Add(14 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(10 * time.Hour).Format(time.RFC3339), toTime: date.Add(12 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(8 * time.Hour).Format(time.RFC3339), toTime: date.Add(10 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(6 * time.Hour).Format(time.RFC3339), toTime: date.Add(8 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(4 * time.Hour).Format(time.RFC3339), toTime: date.Add(6 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Add(2 * time.Hour).Format(time.RFC3339), toTime: date.Add(4 * time.Hour).Format(time.RFC3339)},
-		{fromTime: date.Format(time.RFC3339), toTime: date.Add(2 * time.Hour).Format(time.RFC3339)},
-	}
-
-	// add concurrent processing
-	maxConcurrent := 2
-	semaphore := make(chan struct{}, maxConcurrent)
-	results := make(chan SegmentResult, len(timeSegments))
-
-	// start goroutines to process each time segment
-	for i, segment := range timeSegments {
-		semaphore <- struct{}{}
-		go func(index int, seg struct{ fromTime, toTime string }) {
-			defer func() { <-semaphore }()
-
-			startTime := time.Now()
-			fmt.Printf("Started processing segment %d/%d (%s to %s)\n",
-				index+1, len(timeSegments), seg.fromTime, seg.toTime)
-
-			data, err := withRetry(func() ([]map[string]interface{}, error) {
-				return createFlowReport(
-					config.CloudSecures[selectedCS].APIKey,
-					config.CloudSecures[selectedCS].APISecret,
-					config.CloudSecures[selectedCS].TenantID,
-					*outputFile,
-					"csv",
-					seg.fromTime,
-					seg.toTime,
-					10000000,
-				)
-			}, 3)
-
-			if err == nil {
-				mu.Lock()
-				err = writeCSV(*outputFile, data, index > 0)
-				mu.Unlock()
-				data = nil
-			}
+	var s3Config S3Config
+	if !*noS3Upload {
+		s3Config, err = LoadS3Config("s3config.json")
+		if err != nil {
+			fmt.Printf("Error loading S3 config: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-			processingTime := time.Since(startTime)
-			fmt.Printf("Segment %d processed in %v\n", index+1, processingTime)
+	// Stop cleanly on Ctrl-C or SIGTERM; a second signal terminates immediately
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-signalCtx.Done()
+		stop()
+	}()
+	ctx := signalCtx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-			results <- SegmentResult{
-				Error: err,
-				Index: index,
-			}
-		}(i, segment)
+	// Retry policy: defaults, then csconfig.json, then flags given on the command line
+	retryPolicy := cloudsecure.DefaultRetryPolicy()
+	retryPolicy.Logf = printLine
+	config.Retry.Apply(&retryPolicy)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "retry-attempts":
+			retryPolicy.MaxAttempts = *retryAttempts
+		case "retry-backoff":
+			retryPolicy.InitialBackoff = *retryBackoff
+		case "retry-max-backoff":
+			retryPolicy.MaxBackoff = *retryMaxBackoff
+		case "retry-max-elapsed":
+			retryPolicy.MaxElapsed = *retryMaxElapsed
+		}
+	})
+	if err := retryPolicy.Validate(); err != nil {
+		fmt.Printf("Invalid retry settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := cloudsecure.NewClient(tenantCredentials(credentials))
+	client.Segments = segOpts
+	client.RequestTimeout = *requestTimeout
+	client.Retry = retryPolicy
+
+	// Endpoint, proxy and TLS settings: global ones from csconfig.json, overridden per tenant
+	if err := configureEndpoints(client, config.Settings); err != nil {
+		fmt.Printf("Invalid connection settings: %v\n", err)
+		os.Exit(1)
+	}
+	if *baseURL != "" {
+		client.BaseURL = *baseURL
+		for name, endpoint := range client.TenantEndpoints {
+			endpoint.BaseURL = ""
+			client.TenantEndpoints[name] = endpoint
+		}
+	}
+
+	// Rate limits: a global limit from -rpm or csconfig.json, plus any per tenant limits
+	globalLimit := config.RateLimit
+	if *rateLimit > 0 {
+		globalLimit = &RateLimitSettings{RequestsPerMinute: *rateLimit, Burst: *rateBurst}
+	}
+	client.Limiter = globalLimit.Limiter()
+	client.TenantLimiters = make(map[string]cloudsecure.Limiter)
+	for name, tenant := range config.Tenants {
+		if limiter := tenant.RateLimit.Limiter(); limiter != nil {
+			client.TenantLimiters[name] = limiter
+		}
+	}
+
+	// Output columns: -all-fields, then -columns, then the columns in csconfig.json
+	columnSpecs := config.Columns
+	if *columnsFile != "" {
+		columnSpecs, err = loadColumnSpecs(*columnsFile)
+		if err != nil {
+			fmt.Printf("Error loading columns: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var mapper cloudsecure.FlowMapper
+	if len(columnSpecs) > 0 && !*allFields {
+		mapper, err = cloudsecure.NewColumnMapper(columnSpecs)
+		if err != nil {
+			fmt.Printf("Invalid columns: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// check processing results
-	for i := 0; i < len(timeSegments); i++ {
-		result := <-results
-		if result.Error != nil {
-			fmt.Printf("Error processing segment %d: %v\n", result.Index+1, result.Error)
+	opts := fetchOptions{
+		Resume:       *resume,
+		Concurrency:  *concurrency,
+		Slots:        make(chan struct{}, *concurrency),
+		Filter:       filter,
+		Format:       *format,
+		Mapper:       mapper,
+		AllFields:    *allFields,
+		Enrich:       *enrich,
+		Dedup:        *dedup,
+		DedupKey:     splitList(*dedupKey),
+		Aggregate:    *aggregate,
+		AggregateKey: splitList(*groupBy),
+		Bucket:       *bucket,
+		Compress:     *compress,
+	}
+	if *aggregate {
+		if *allFields || *enrich || *columnsFile != "" {
+			fmt.Println("-aggregate cannot be combined with -all-fields, -enrich or -columns")
+			os.Exit(1)
+		}
+		if _, err := cloudsecure.NewAggregator(opts.AggregateKey, opts.Bucket); err != nil {
+			fmt.Printf("Invalid aggregation: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
 	// modify S3 upload logic
+	var upload func(string) error
 	if !*noS3Upload {
-		s3Config, err := LoadS3Config("s3config.json")
-		if err != nil {
-			fmt.Printf("Error loading S3 config: %v\n", err)
-			os.Exit(1)
+		upload = func(fileName string) error {
+			return s3utils.UploadToS3(s3Config.Region, s3Config.ProfileName, fileName, s3Config.BucketName, s3Config.FolderName)
 		}
+	}
 
-		err = s3utils.UploadToS3(s3Config.Region, s3Config.ProfileName, *outputFile, s3Config.BucketName, s3Config.FolderName)
+	if *follow {
+		err := runFollow(ctx, client, selectedTenants, opts, followOptions{
+			Interval:   *pollInterval,
+			Lag:        *pollLag,
+			StateFile:  *stateFile,
+			OutputFile: *outputFile,
+		}, upload)
 		if err != nil {
-			fmt.Printf("Error uploading to S3: %v\n", err)
+			fmt.Printf("Error following flows: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Data retrieval, CSV creation and S3 upload completed successfully. Output saved to %s\n", *outputFile)
+		return
+	}
+
+	ext := cloudsecure.FormatExtension(*format) + cloudsecure.CompressionExtension(*compress)
+	plan := planJobs(selectedTenants, dates, *outputFile, ext, *combined)
+	results := runJobs(ctx, client, plan, opts, upload)
+	if !printSummary(results, *dedup) {
+		os.Exit(1)
+	}
+	if *noS3Upload {
+		fmt.Println("Data retrieval and CSV creation completed successfully. S3 upload skipped.")
 	} else {
-		fmt.Printf("Data retrieval and CSV creation completed successfully. S3 upload skipped. Output saved to %s\n", *outputFile)
+		fmt.Println("Data retrieval, CSV creation and S3 upload completed successfully.")
+	}
+}
+
+// parseDateRange turns the date flags into the list of days to retrieve.
+// Days are UTC days, and yesterday is the day before the current UTC day
+// whatever the local time zone. With no flags set it returns yesterday.
+func parseDateRange(date, from, to string, last int, now time.Time) ([]time.Time, error) {
+	now = now.UTC()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+
+	if date != "" && (from != "" || to != "" || last != 0) {
+		return nil, fmt.Errorf("--date cannot be combined with --from, --to or --last")
+	}
+	if last != 0 && (from != "" || to != "") {
+		return nil, fmt.Errorf("--last cannot be combined with --from or --to")
+	}
+
+	var start, end time.Time
+	var err error
+	switch {
+	case date != "":
+		start, err = time.Parse("20060102", date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --date: %v", err)
+		}
+		end = start
+	case last < 0:
+		return nil, fmt.Errorf("--last must be a positive number of days")
+	case last > 0:
+		start = yesterday.AddDate(0, 0, -(last - 1))
+		end = yesterday
+	case from != "":
+		start, err = time.Parse("20060102", from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --from: %v", err)
+		}
+		end = yesterday
+		if to != "" {
+			end, err = time.Parse("20060102", to)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --to: %v", err)
+			}
+		}
+	case to != "":
+		return nil, fmt.Errorf("--to requires --from")
+	default:
+		start, end = yesterday, yesterday
+	}
+
+	if end.Before(start) {
+		return nil, fmt.Errorf("end date %s is before start date %s", end.Format("20060102"), start.Format("20060102"))
+	}
+
+	var dates []time.Time
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
 	}
+	return dates, nil
+}
+
+// selectTenants resolves the -cs flag: "all" for every configured tenant or
+// a comma separated list of names
+func selectTenants(csName string, config csutils.CloudSecureConfig) ([]string, error) {
+	var tenants []string
+	if csName == "all" {
+		for name := range config.CloudSecures {
+			tenants = append(tenants, name)
+		}
+		sort.Strings(tenants)
+		if len(tenants) == 0 {
+			return nil, fmt.Errorf("no CloudSecure tenants configured")
+		}
+		return tenants, nil
+	}
+
+	var unknown []string
+	for _, name := range strings.Split(csName, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, exists := config.CloudSecures[name]; !exists {
+			unknown = append(unknown, name)
+		}
+		tenants = append(tenants, name)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("CloudSecure not found: %s", strings.Join(unknown, ", "))
+	}
+	return tenants, nil
+}
+
+// configureEndpoints sets the base URL and HTTP client of client, and of
+// every tenant with its own connection settings
+func configureEndpoints(client *cloudsecure.Client, settings Settings) error {
+	if settings.Connection != nil {
+		endpoint, err := settings.Connection.Endpoint()
+		if err != nil {
+			return err
+		}
+		if endpoint.BaseURL != "" {
+			client.BaseURL = endpoint.BaseURL
+		}
+		client.HTTPClient = endpoint.HTTPClient
+	}
+
+	client.TenantEndpoints = make(map[string]cloudsecure.APIEndpoint)
+	for name, tenant := range settings.Tenants {
+		if tenant.Connection == nil {
+			continue
+		}
+		endpoint, err := settings.Connection.Merge(tenant.Connection).Endpoint()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		client.TenantEndpoints[name] = endpoint
+	}
+	return nil
+}
+
+// loadColumnSpecs reads a JSON array of output columns
+func loadColumnSpecs(fileName string) ([]cloudsecure.ColumnSpec, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var specs []cloudsecure.ColumnSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", fileName, err)
+	}
+	return specs, nil
+}
+
+// tenantCredentials returns the API credentials of every configured tenant
+func tenantCredentials(config csutils.CloudSecureConfig) map[string]cloudsecure.Credentials {
+	tenants := make(map[string]cloudsecure.Credentials, len(config.CloudSecures))
+	for name, info := range config.CloudSecures {
+		tenants[name] = cloudsecure.Credentials{
+			APIKey:    info.APIKey,
+			APISecret: info.APISecret,
+			TenantID:  info.TenantID,
+		}
+	}
+	return tenants
+}
+
+// printLine prints the retry and segment messages of the cloudsecure package
+func printLine(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
 }
 
 func addNewCloudSecure(config *csutils.CloudSecureConfig) string {
@@ -397,6 +648,10 @@ func addNewCloudSecure(config *csutils.CloudSecureConfig) string {
 	reader := bufio.NewReader(os.Stdin)
 	cloudSecureName, _ := reader.ReadString('\n')
 	cloudSecureName = strings.TrimSpace(cloudSecureName)
+	if cloudSecureName == "" {
+		fmt.Println("CloudSecure name cannot be empty")
+		os.Exit(1)
+	}
 
 	config.CloudSecures[cloudSecureName] = cloudSecureInfo
 	return cloudSecureName
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseDateRange(t *testing.T) {
+	now := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		date, from, to string
+		last           int
+		first, lastDay string
+		days           int
+	}{
+		{name: "no flags", first: "20261015", lastDay: "20261015", days: 1},
+		{name: "date", date: "20240229", first: "20240229", lastDay: "20240229", days: 1},
+		{name: "from", from: "20261012", first: "20261012", lastDay: "20261015", days: 4},
+		{name: "from and to", from: "20260227", to: "20260302", first: "20260227", lastDay: "20260302", days: 4},
+		{name: "from equals to", from: "20260101", to: "20260101", first: "20260101", lastDay: "20260101", days: 1},
+		{name: "across a year", from: "20251230", to: "20260102", first: "20251230", lastDay: "20260102", days: 4},
+		{name: "last", last: 7, first: "20261009", lastDay: "20261015", days: 7},
+		{name: "last 1", last: 1, first: "20261015", lastDay: "20261015", days: 1},
+	}
+	for _, tt := range tests {
+		dates, err := parseDateRange(tt.date, tt.from, tt.to, tt.last, now)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(dates) != tt.days || dates[0].Format("20060102") != tt.first || dates[len(dates)-1].Format("20060102") != tt.lastDay {
+			t.Errorf("%s: %d days from %s to %s, want %d from %s to %s", tt.name, len(dates),
+				dates[0].Format("20060102"), dates[len(dates)-1].Format("20060102"), tt.days, tt.first, tt.lastDay)
+		}
+		for i, d := range dates {
+			if d.Location() != time.UTC || d.Hour() != 0 || d.Minute() != 0 {
+				t.Errorf("%s: day %d is %v, want UTC midnight", tt.name, i, d)
+			}
+			if i > 0 && !d.Equal(dates[i-1].Add(24*time.Hour)) {
+				t.Errorf("%s: day %d is %v, not the day after %v", tt.name, i, d, dates[i-1])
+			}
+		}
+	}
+}
+
+func TestParseDateRangeErrors(t *testing.T) {
+	now := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		date, from, to string
+		last           int
+	}{
+		{name: "date and from", date: "20261001", from: "20261001"},
+		{name: "date and to", date: "20261001", to: "20261002"},
+		{name: "date and last", date: "20261001", last: 3},
+		{name: "last and from", from: "20261001", last: 3},
+		{name: "last and to", to: "20261002", last: 3},
+		{name: "to without from", to: "20261002"},
+		{name: "negative last", last: -1},
+		{name: "to before from", from: "20261005", to: "20261001"},
+		{name: "from after yesterday", from: "20261016"},
+		{name: "invalid date", date: "2026-10-01"},
+		{name: "no such day", date: "20260230"},
+		{name: "invalid from", from: "yesterday"},
+		{name: "invalid to", from: "20261001", to: "202610"},
+	}
+	for _, tt := range tests {
+		if dates, err := parseDateRange(tt.date, tt.from, tt.to, tt.last, now); err == nil {
+			t.Errorf("%s: parseDateRange = %v, want an error", tt.name, dates)
+		}
+	}
+}
+
+func TestParseDateRangeUTCBoundaries(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	losAngeles, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		now       time.Time
+		yesterday string
+	}{
+		{time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), "20261015"},
+		{time.Date(2026, 10, 16, 23, 59, 59, 0, time.UTC), "20261015"},
+		// 08:00 in Tokyo is still the 15th in UTC
+		{time.Date(2026, 10, 16, 8, 0, 0, 0, tokyo), "20261014"},
+		{time.Date(2026, 10, 16, 9, 0, 0, 0, tokyo), "20261015"},
+		// 20:00 in Los Angeles is already the 17th in UTC
+		{time.Date(2026, 10, 16, 20, 0, 0, 0, losAngeles), "20261016"},
+		{time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC), "20251231"},
+	}
+	for _, tt := range tests {
+		dates, err := parseDateRange("", "", "", 0, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dates[0].Format("20060102"); got != tt.yesterday {
+			t.Errorf("yesterday at %v = %s, want %s", tt.now, got, tt.yesterday)
+		}
+	}
+
+	// a day given with -date covers its UTC midnight to midnight
+	dates, err := parseDateRange("20261015", "", "", 0, time.Date(2026, 10, 16, 8, 0, 0, 0, tokyo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC); !dates[0].Equal(want) || dates[0].Location() != time.UTC {
+		t.Errorf("-date 20261015 = %v, want %v", dates[0], want)
+	}
+}
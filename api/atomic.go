@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is an output file written under a temporary name in the same
+// directory and renamed into place by Commit, so that readers of the final
+// name, such as an S3 sync, never see a partial file
+type atomicFile struct {
+	*os.File
+	name string
+	perm os.FileMode
+	done bool
+}
+
+// createAtomic creates the temporary file for fileName, which gets the
+// permissions perm when committed
+func createAtomic(fileName string, perm os.FileMode) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: tmp, name: fileName, perm: perm}, nil
+}
+
+// Commit syncs the file to disk and renames it to its final name
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("%s already closed", f.name)
+	}
+	f.done = true
+	err := f.Sync()
+	if err == nil {
+		err = f.Chmod(f.perm)
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("error writing %s: %v", f.name, err)
+	}
+	syncDir(filepath.Dir(f.name))
+	return nil
+}
+
+// Close removes the temporary file unless it was committed, leaving any
+// previous file of the same name as it was
+func (f *atomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// writeFileAtomic writes data to fileName through a temporary file, like
+// os.WriteFile
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	file, err := createAtomic(fileName, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// syncDir syncs a directory so that a rename in it survives a crash. Not
+// every platform supports it, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
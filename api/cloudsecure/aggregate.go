@@ -0,0 +1,192 @@
+package cloudsecure
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Aggregation buckets
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// AggregateBuckets are the time buckets supported by NewAggregator
+var AggregateBuckets = []string{BucketHour, BucketDay}
+
+// DefaultAggregateKey groups flows by status, endpoints, destination port and protocol
+var DefaultAggregateKey = []string{"status", "src", "dst", "dst_port", "protocol"}
+
+// aggregateColumns are the positions in FlowColumns of the group-by fields
+// with a column of their own
+var aggregateColumns = map[string]int{
+	"status":   0,
+	"src":      3,
+	"dst":      4,
+	"dst_port": 5,
+	"protocol": 6,
+}
+
+// Aggregator sums flows into one row per group and time bucket. Rows have
+// the FlowColumns, with FirstDetected the earliest start, LastDetected the
+// latest end and ByteCount the total of the group, followed by the group-by
+// fields without a column of their own, FlowCount and Bucket. Columns of
+// fields not grouped by are left empty.
+type Aggregator struct {
+	keys    []string
+	bucket  string
+	columns []Column
+	groups  map[string]*flowGroup
+	order   []*flowGroup
+}
+
+// flowGroup is one output row of an Aggregator
+type flowGroup struct {
+	values    []string
+	bucket    string
+	srcType   string
+	dstType   string
+	first     string
+	last      string
+	bytes     int64
+	flowCount int
+}
+
+// NewAggregator returns an Aggregator grouping by keys, named as in
+// NewDeduplicator, and bucket, one of AggregateBuckets. Empty keys means
+// DefaultAggregateKey.
+func NewAggregator(keys []string, bucket string) (*Aggregator, error) {
+	if len(keys) == 0 {
+		keys = DefaultAggregateKey
+	}
+	if bucket != BucketHour && bucket != BucketDay {
+		return nil, fmt.Errorf("unknown bucket %q, expected one of %s", bucket, strings.Join(AggregateBuckets, ", "))
+	}
+
+	a := &Aggregator{keys: keys, bucket: bucket, groups: make(map[string]*flowGroup)}
+	a.columns = append(a.columns, FlowColumns...)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		switch {
+		case strings.TrimSpace(key) == "":
+			return nil, fmt.Errorf("empty group-by field")
+		case key == "start_time" || key == "end_time" || key == "bytes":
+			return nil, fmt.Errorf("cannot group by %s, it is aggregated", key)
+		case seen[key]:
+			return nil, fmt.Errorf("duplicate group-by field %q", key)
+		}
+		seen[key] = true
+		if _, ok := aggregateColumns[key]; !ok {
+			a.columns = append(a.columns, Column{Name: key})
+		}
+	}
+	a.columns = append(a.columns, Column{Name: "FlowCount", Integer: true}, Column{Name: "Bucket"})
+	return a, nil
+}
+
+// Columns returns the columns of the aggregated rows
+func (a *Aggregator) Columns() []Column {
+	return a.columns
+}
+
+// Add adds flow to its group
+func (a *Aggregator) Add(flow Flow) error {
+	values, err := fieldValues(flow, a.keys)
+	if err != nil {
+		return err
+	}
+	bucket := a.bucketOf(flow.StartTime)
+	id := bucket + "\x00" + strings.Join(values, "\x00")
+
+	group, ok := a.groups[id]
+	if !ok {
+		group = &flowGroup{values: values, bucket: bucket, first: flow.StartTime, last: flow.EndTime}
+		a.groups[id] = group
+		a.order = append(a.order, group)
+	}
+	if group.srcType == "" {
+		group.srcType = flow.Src.Type
+	}
+	if group.dstType == "" {
+		group.dstType = flow.Dst.Type
+	}
+	if detectedBefore(flow.StartTime, group.first) {
+		group.first = flow.StartTime
+	}
+	if detectedBefore(group.last, flow.EndTime) {
+		group.last = flow.EndTime
+	}
+	group.bytes += flow.Bytes
+	group.flowCount++
+	return nil
+}
+
+// Len returns the number of groups
+func (a *Aggregator) Len() int {
+	return len(a.order)
+}
+
+// Records calls fn with the row of every group, in the order the groups
+// were first seen
+func (a *Aggregator) Records(fn func(record []string) error) error {
+	for _, group := range a.order {
+		record := make([]string, len(FlowColumns), len(a.columns))
+		record[1] = group.first
+		record[2] = group.last
+		record[7] = strconv.FormatInt(group.bytes, 10)
+		for i, key := range a.keys {
+			column, ok := aggregateColumns[key]
+			if !ok {
+				record = append(record, group.values[i])
+				continue
+			}
+			record[column] = group.values[i]
+			switch key {
+			case "src":
+				record[8] = group.srcType
+			case "dst":
+				record[9] = group.dstType
+			}
+		}
+		record = append(record, strconv.Itoa(group.flowCount), group.bucket)
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketOf returns the start of the bucket of a flow starting at start, or
+// empty when start cannot be read
+func (a *Aggregator) bucketOf(start string) string {
+	t, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return ""
+	}
+	t = t.UTC()
+	if a.bucket == BucketDay {
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	} else {
+		t = t.Truncate(time.Hour)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// detectedBefore reports whether detection time a is before b. Times that
+// cannot be read are compared as text, and empty times are never before.
+func detectedBefore(a, b string) bool {
+	if a == "" {
+		return false
+	}
+	if b == "" {
+		return true
+	}
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ta.Before(tb)
+}
@@ -0,0 +1,339 @@
+// Package cloudsecure retrieves traffic flows from the CloudSecure flows API.
+package cloudsecure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the CloudSecure API used when Client.BaseURL is empty
+const DefaultBaseURL = "https://cloud.illum.io"
+
+// flowsPath is the flows endpoint relative to the base URL
+const flowsPath = "/api/v1/flows"
+
+// FlowSource produces the flows of a tenant in a time range
+type FlowSource interface {
+	Flows(ctx context.Context, tenant string, from, to time.Time) iter.Seq2[Flow, error]
+}
+
+// Credentials authenticate requests for one tenant
+type Credentials struct {
+	APIKey    string
+	APISecret string
+	TenantID  string
+}
+
+// FlowQuery describes a single flows request
+type FlowQuery struct {
+	From       time.Time
+	To         time.Time
+	MaxResults int
+	FileName   string
+
+	// FileFormat is the report format requested from the API, csv when
+	// empty. It does not affect the output, which NewRecordWriter formats.
+	FileFormat string
+
+	// Filter drops the flows that do not pass it as they are received
+	Filter *FlowFilter
+}
+
+// Client is a FlowSource backed by the CloudSecure API
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Retry      RetryPolicy
+	Segments   SegmentOptions
+
+	// RequestTimeout limits each request, including reading the response.
+	// Zero means no limit.
+	RequestTimeout time.Duration
+
+	// Limiter paces the requests of all tenants, and TenantLimiters the
+	// requests of individual tenants. Every request, including retries,
+	// waits for both. Nil limiters do not limit.
+	Limiter        Limiter
+	TenantLimiters map[string]Limiter
+
+	// TenantEndpoints override BaseURL and HTTPClient for individual tenants
+	TenantEndpoints map[string]APIEndpoint
+
+	// Filter restricts the flows returned by Flows. Nil returns every flow.
+	Filter *FlowFilter
+
+	tenants map[string]Credentials
+}
+
+// APIEndpoint is where the requests of a tenant are sent. Empty fields fall back
+// to the Client's.
+type APIEndpoint struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the given tenants, keyed by name
+func NewClient(tenants map[string]Credentials) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		HTTPClient: &http.Client{},
+		Retry:      DefaultRetryPolicy(),
+		Segments:   DefaultSegmentOptions(),
+		tenants:    tenants,
+	}
+}
+
+// Flows returns every flow of tenant in [from, to) that passes Filter.
+//
+// The flows of each window are buffered in memory, up to Segments.MaxResults
+// of them, and yielded once the window is complete: only then is it known
+// whether the window was truncated and has to be split, and a failed attempt
+// can be retried without yielding its flows twice. Callers that cannot hold a
+// window in memory can use StreamFlows, which yields flows as they are
+// decoded, and manage their own windows and retries.
+func (c *Client) Flows(ctx context.Context, tenant string, from, to time.Time) iter.Seq2[Flow, error] {
+	return func(yield func(Flow, error) bool) {
+		planner := NewSegmentPlanner(from, to, c.Segments)
+		for {
+			seg, ok := planner.Next()
+			if !ok {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				planner.Done(seg, 0, err)
+				break
+			}
+
+			// truncation is judged by the flows received, before Filter, so
+			// only the flows that pass it are buffered
+			var flows []Flow
+			query := FlowQuery{From: seg.From, To: seg.To, MaxResults: c.Segments.MaxResults, Filter: c.Filter}
+			count, err := WithRetry(ctx, c.Retry, func() (int, error) {
+				flows = flows[:0]
+				return c.StreamFlows(ctx, tenant, query, func(flow Flow) error {
+					flows = append(flows, flow)
+					return nil
+				})
+			})
+			planner.Done(seg, count, err)
+			if err != nil || planner.ShouldSplit(seg, count) {
+				continue
+			}
+			for _, flow := range flows {
+				if !yield(flow, nil) {
+					return
+				}
+			}
+		}
+		if err := planner.Err(); err != nil {
+			yield(Flow{}, err)
+		}
+	}
+}
+
+// FetchFlows performs a single flows request and returns all of its flows
+// that pass q.Filter, retrying failed attempts
+func (c *Client) FetchFlows(ctx context.Context, tenant string, q FlowQuery) ([]Flow, error) {
+	return WithRetry(ctx, c.Retry, func() ([]Flow, error) {
+		var flows []Flow
+		_, err := c.StreamFlows(ctx, tenant, q, func(flow Flow) error {
+			flows = append(flows, flow)
+			return nil
+		})
+		return flows, err
+	})
+}
+
+// StreamFlows performs a single flows request and calls fn with each flow as
+// it is decoded from the response, so the response is never held in memory.
+// Flows that do not pass q.Filter are skipped. It returns the number of flows
+// received, including skipped ones, since that is what tells whether the
+// response was cut off at MaxResults. StreamFlows does not retry: flows
+// passed to fn before a failure are not sent again. Errors can be passed to
+// Classify to decide whether to try again.
+func (c *Client) StreamFlows(ctx context.Context, tenant string, q FlowQuery, fn func(Flow) error) (int, error) {
+	creds, ok := c.tenants[tenant]
+	if !ok {
+		return 0, fmt.Errorf("unknown tenant %q", tenant)
+	}
+
+	baseURL, client := c.endpoint(tenant)
+	url := strings.TrimSuffix(baseURL, "/") + flowsPath
+
+	fileFormat := q.FileFormat
+	if fileFormat == "" {
+		fileFormat = "csv"
+	}
+
+	// Encode the API key and secret
+	credentials := fmt.Sprintf("%s:%s", creds.APIKey, creds.APISecret)
+	encodedCredentials := base64.StdEncoding.EncodeToString([]byte(credentials))
+
+	headers := map[string]string{
+		"accept":        "*/*",
+		"content-type":  "application/json",
+		"Authorization": "Basic " + encodedCredentials,
+		"x-tenant-id":   creds.TenantID,
+	}
+
+	data := map[string]interface{}{
+		"fileName":   q.FileName,
+		"fileFormat": "FILE_FORMAT_" + strings.ToUpper(fileFormat),
+		"period": map[string]string{
+			"start_time": q.From.Format(time.RFC3339),
+			"end_time":   q.To.Format(time.RFC3339),
+		},
+		"max_results": q.MaxResults,
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling data: %v", err)
+	}
+
+	for _, limiter := range []Limiter{c.Limiter, c.TenantLimiters[tenant]} {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return 0, fmt.Errorf("error waiting for rate limit: %w", err)
+		}
+	}
+
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %v", err)
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, &StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+
+	return decodeFlows(resp.Body, func(flow Flow) error {
+		if !q.Filter.Match(flow) {
+			return nil
+		}
+		return fn(flow)
+	})
+}
+
+// endpoint returns the base URL and HTTP client used for tenant
+func (c *Client) endpoint(tenant string) (string, *http.Client) {
+	baseURL, client := c.BaseURL, c.HTTPClient
+	if override, ok := c.TenantEndpoints[tenant]; ok {
+		if override.BaseURL != "" {
+			baseURL = override.BaseURL
+		}
+		if override.HTTPClient != nil {
+			client = override.HTTPClient
+		}
+	}
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return baseURL, client
+}
+
+// decodeFlows reads a flows response token by token, calling fn for each
+// element of the "flows" array. Other members of the response are skipped.
+func decodeFlows(r io.Reader, fn func(Flow) error) (int, error) {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, fmt.Errorf("error reading response: %w", err)
+	}
+
+	count := 0
+	found := false
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return count, fmt.Errorf("error reading response: %w", err)
+		}
+		if key, _ := token.(string); key != "flows" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return count, fmt.Errorf("error reading response: %w", err)
+			}
+			continue
+		}
+		found = true
+
+		// an empty or null list is a quiet segment
+		token, err = dec.Token()
+		if err != nil {
+			return count, fmt.Errorf("error reading flows: %w", err)
+		}
+		if token == nil {
+			continue
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return count, fmt.Errorf("error reading flows: expected array, got %v", token)
+		}
+		for dec.More() {
+			var flow Flow
+			if err := dec.Decode(&flow); err != nil {
+				return count, fmt.Errorf("error decoding flow %d: %w", count+1, err)
+			}
+			count++
+			if err := fn(flow); err != nil {
+				return count, err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return count, fmt.Errorf("error reading flows: %w", err)
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return count, fmt.Errorf("error reading response: %w", err)
+	}
+	if !found {
+		return count, fmt.Errorf("no flows data found in the response")
+	}
+	return count, nil
+}
+
+// expectDelim reads the next token and checks that it is delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package cloudsecure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// FlowMapper turns flows into output rows
+type FlowMapper interface {
+	// Columns returns the output columns, in the order of Record
+	Columns() []Column
+
+	// Record returns the row of one flow
+	Record(flow Flow) ([]string, error)
+}
+
+// DefaultMapper writes the columns of Flow.Record
+var DefaultMapper FlowMapper = defaultMapper{}
+
+type defaultMapper struct{}
+
+func (defaultMapper) Columns() []Column {
+	return FlowColumns
+}
+
+func (defaultMapper) Record(flow Flow) ([]string, error) {
+	return flow.Record(), nil
+}
+
+// EnrichmentColumns are the endpoint metadata columns added by NewEnrichedMapper
+var EnrichmentColumns = []Column{
+	{Name: "Source_Workload"},
+	{Name: "Source_Labels"},
+	{Name: "Source_VPC"},
+	{Name: "Source_Account"},
+	{Name: "Dest_Workload"},
+	{Name: "Dest_Labels"},
+	{Name: "Dest_VPC"},
+	{Name: "Dest_Account"},
+}
+
+// enrichedMapper adds the EnrichmentColumns to the rows of another mapper
+type enrichedMapper struct {
+	base    FlowMapper
+	columns []Column
+}
+
+// NewEnrichedMapper returns a FlowMapper writing the columns of base followed
+// by the workload, labels, VPC and account of both endpoints
+func NewEnrichedMapper(base FlowMapper) FlowMapper {
+	columns := append(append([]Column(nil), base.Columns()...), EnrichmentColumns...)
+	return &enrichedMapper{base: base, columns: columns}
+}
+
+func (m *enrichedMapper) Columns() []Column {
+	return m.columns
+}
+
+func (m *enrichedMapper) Record(flow Flow) ([]string, error) {
+	record, err := m.base.Record(flow)
+	if err != nil {
+		return nil, err
+	}
+	return append(record,
+		flow.Src.Workload, flow.Src.Labels, flow.Src.VPC, flow.Src.Account,
+		flow.Dst.Workload, flow.Dst.Labels, flow.Dst.VPC, flow.Dst.Account,
+	), nil
+}
+
+// ColumnSpec maps a field of the flow JSON to an output column
+type ColumnSpec struct {
+	// Name is the output column name
+	Name string `json:"name"`
+
+	// Path is the field in the flow as received from the API, with the keys
+	// of nested objects and array indexes separated by dots, e.g.
+	// "src.ip_address" or "labels.0.value". Objects and arrays are written as
+	// JSON.
+	Path string `json:"path"`
+
+	// Default is written when the field is missing or null
+	Default string `json:"default,omitempty"`
+
+	// Integer columns are written as numbers by the JSON and Parquet writers
+	Integer bool `json:"integer,omitempty"`
+}
+
+// columnMapper is the FlowMapper of a list of ColumnSpecs
+type columnMapper struct {
+	specs   []ColumnSpec
+	columns []Column
+}
+
+// NewColumnMapper returns a FlowMapper writing one column per spec, in order
+func NewColumnMapper(specs []ColumnSpec) (FlowMapper, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no columns configured")
+	}
+	m := &columnMapper{specs: specs}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.Name == "" || spec.Path == "" {
+			return nil, fmt.Errorf("column %q needs both a name and a path", spec.Name+spec.Path)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate column %q", spec.Name)
+		}
+		seen[spec.Name] = true
+		m.columns = append(m.columns, Column{Name: spec.Name, Integer: spec.Integer})
+	}
+	return m, nil
+}
+
+func (m *columnMapper) Columns() []Column {
+	return m.columns
+}
+
+func (m *columnMapper) Record(flow Flow) ([]string, error) {
+	fields, err := flattenFlow(flow)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]string, len(m.specs))
+	for i, spec := range m.specs {
+		value, ok := fields[spec.Path]
+		if !ok || value.null {
+			record[i] = spec.Default
+			continue
+		}
+		record[i] = value.text
+	}
+	return record, nil
+}
+
+// FieldCollector finds every field of a set of flows, for writing all of
+// them with NewColumnMapper. Nested objects are flattened into one column
+// per field, named by its dotted path; arrays are kept as JSON.
+type FieldCollector struct {
+	order      []string
+	seen       map[string]bool
+	nonInteger map[string]bool
+}
+
+// NewFieldCollector returns an empty FieldCollector
+func NewFieldCollector() *FieldCollector {
+	return &FieldCollector{seen: make(map[string]bool), nonInteger: make(map[string]bool)}
+}
+
+// Add records the fields of flow
+func (c *FieldCollector) Add(flow Flow) error {
+	return walkFields("", flow.Raw, false, func(path string, value fieldValue) {
+		if !c.seen[path] {
+			c.seen[path] = true
+			c.order = append(c.order, path)
+		}
+		if !value.null && !value.integer {
+			c.nonInteger[path] = true
+		}
+	})
+}
+
+// Specs returns a column for every field found, in the order the fields
+// were first seen. Fields that only ever held integers are Integer columns.
+func (c *FieldCollector) Specs() []ColumnSpec {
+	specs := make([]ColumnSpec, len(c.order))
+	for i, path := range c.order {
+		specs[i] = ColumnSpec{Name: path, Path: path, Integer: !c.nonInteger[path]}
+	}
+	return specs
+}
+
+// fieldValue is one field of a flattened flow
+type fieldValue struct {
+	text    string
+	null    bool
+	integer bool
+}
+
+// flattenFlow returns every field of flow keyed by dotted path, including
+// objects, arrays and the elements of arrays
+func flattenFlow(flow Flow) (map[string]fieldValue, error) {
+	fields := make(map[string]fieldValue)
+	err := walkFields("", flow.Raw, true, func(path string, value fieldValue) {
+		fields[path] = value
+	})
+	return fields, err
+}
+
+// walkFields calls fn with the fields of a JSON value in document order.
+// Scalars and arrays are always passed to fn, empty objects as well; with
+// containers, objects and the elements of arrays are too.
+func walkFields(prefix string, raw json.RawMessage, containers bool, fn func(path string, value fieldValue)) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return fmt.Errorf("empty value at %q", prefix)
+	}
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch raw[0] {
+	case '{', '[':
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("error decoding flow: %v", err)
+		}
+		object := raw[0] == '{'
+		if prefix != "" && (containers || !object || !dec.More()) {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil {
+				return fmt.Errorf("error decoding flow: %v", err)
+			}
+			fn(prefix, fieldValue{text: compact.String()})
+		}
+		if !object && !containers {
+			return nil
+		}
+		for i := 0; dec.More(); i++ {
+			key := strconv.Itoa(i)
+			if object {
+				token, err := dec.Token()
+				if err != nil {
+					return fmt.Errorf("error decoding flow: %v", err)
+				}
+				key, _ = token.(string)
+			}
+			var child json.RawMessage
+			if err := dec.Decode(&child); err != nil {
+				return fmt.Errorf("error decoding flow: %v", err)
+			}
+			if err := walkFields(join(key), child, containers, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 'n':
+		fn(prefix, fieldValue{null: true})
+	case '"':
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return fmt.Errorf("error decoding flow: %v", err)
+		}
+		fn(prefix, fieldValue{text: text})
+	default:
+		_, err := strconv.ParseInt(string(raw), 10, 64)
+		fn(prefix, fieldValue{text: string(raw), integer: err == nil})
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package cloudsecure
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Compressions are the output compressions supported by NewCompressWriter
+var Compressions = []string{"gzip", "zstd"}
+
+// CompressionExtension returns the extension added to files compressed with
+// compression, or "" without compression
+func CompressionExtension(compression string) string {
+	switch compression {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+// CheckCompression returns an error when compression is not one of
+// Compressions or cannot be used: zstd runs the zstd command, which has to be
+// found on the PATH.
+func CheckCompression(compression string) error {
+	switch compression {
+	case "", "gzip":
+		return nil
+	case "zstd":
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("zstd compression needs the zstd command, install it (e.g. apt install zstd or brew install zstd) or put it on the PATH: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected one of %v", compression, Compressions)
+}
+
+// NewCompressWriter returns a writer compressing to w, or w itself when
+// compression is empty. zstd runs the zstd command, see CheckCompression.
+// Closing the writer completes the compressed stream without closing w;
+// streams written one after another to the same file are read back as one.
+func NewCompressWriter(compression string, w io.Writer) (io.WriteCloser, error) {
+	if err := CheckCompression(compression); err != nil {
+		return nil, err
+	}
+	switch compression {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("error starting zstd: %v", err)
+		}
+		return &commandWriter{cmd: cmd, stdin: stdin}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q, expected one of %v", compression, Compressions)
+}
+
+// nopWriteCloser is a writer without compression
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// commandWriter writes to the standard input of a compression command
+type commandWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	closed bool
+}
+
+func (c *commandWriter) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close ends the input and waits for the command to write the rest
+func (c *commandWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if err := c.stdin.Close(); err != nil {
+		c.cmd.Wait()
+		return err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package cloudsecure
+
+import "strconv"
+
+// Record returns the flow as a row matching FlowColumns. Endpoints without an
+// IP address are written as their hostname, FQDN or cloud resource ID, with
+// the kind of address in the EndpointType columns.
+func (f Flow) Record() []string {
+	return []string{
+		f.Status,
+		f.StartTime,
+		f.EndTime,
+		f.Src.Address,
+		f.Dst.Address,
+		strconv.Itoa(f.DstPort),
+		f.Protocol,
+		strconv.FormatInt(f.Bytes, 10),
+		f.Src.Type,
+		f.Dst.Type,
+	}
+}
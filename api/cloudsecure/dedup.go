@@ -0,0 +1,136 @@
+package cloudsecure
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDedupKey identifies a flow by its endpoints, destination port,
+// protocol and first and last detection times
+var DefaultDedupKey = []string{"src", "dst", "dst_port", "protocol", "start_time", "end_time"}
+
+// flowFields are the key fields read from the decoded Flow rather than its JSON
+var flowFields = map[string]func(Flow) string{
+	"status":     func(f Flow) string { return f.Status },
+	"start_time": func(f Flow) string { return f.StartTime },
+	"end_time":   func(f Flow) string { return f.EndTime },
+	"src":        func(f Flow) string { return f.Src.Address },
+	"dst":        func(f Flow) string { return f.Dst.Address },
+	"dst_port":   func(f Flow) string { return strconv.Itoa(f.DstPort) },
+	"protocol":   func(f Flow) string { return f.Protocol },
+	"bytes":      func(f Flow) string { return strconv.FormatInt(f.Bytes, 10) },
+}
+
+// Deduplicator drops flows returned more than once, such as flows active
+// across the boundary of two segments. Flows must be passed one segment at a
+// time in chronological order. Memory stays bounded: a flow is forgotten once
+// a segment starts after its last detection time, or, when that time cannot
+// be read, once the segment after its own has been passed.
+type Deduplicator struct {
+	fields  []string
+	seen    map[[16]byte]dedupEntry
+	segment int
+	removed int
+}
+
+// dedupEntry is a remembered flow
+type dedupEntry struct {
+	lastDetected time.Time
+	segment      int
+}
+
+// NewDeduplicator returns a Deduplicator identifying flows by fields. Fields
+// are the names of DefaultDedupKey, status or bytes, or else dotted paths in
+// the flow JSON as in ColumnSpec. Empty fields means DefaultDedupKey.
+func NewDeduplicator(fields []string) (*Deduplicator, error) {
+	if len(fields) == 0 {
+		fields = DefaultDedupKey
+	}
+	for _, field := range fields {
+		if strings.TrimSpace(field) == "" {
+			return nil, fmt.Errorf("empty dedup key field")
+		}
+	}
+	return &Deduplicator{fields: fields, seen: make(map[[16]byte]dedupEntry)}, nil
+}
+
+// StartSegment is called before the flows of the segment starting at from,
+// and forgets the flows that cannot appear in it
+func (d *Deduplicator) StartSegment(from time.Time) {
+	d.segment++
+	for key, entry := range d.seen {
+		if entry.lastDetected.IsZero() {
+			if entry.segment < d.segment-1 {
+				delete(d.seen, key)
+			}
+		} else if entry.lastDetected.Before(from) {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// Seen reports whether a flow with the same key was already passed, and
+// remembers the flow otherwise
+func (d *Deduplicator) Seen(flow Flow) (bool, error) {
+	key, err := d.key(flow)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := d.seen[key]; ok {
+		d.removed++
+		return true, nil
+	}
+
+	entry := dedupEntry{segment: d.segment}
+	if last, err := time.Parse(time.RFC3339, flow.EndTime); err == nil {
+		entry.lastDetected = last
+	}
+	d.seen[key] = entry
+	return false, nil
+}
+
+// Removed returns the number of duplicates found by Seen
+func (d *Deduplicator) Removed() int {
+	return d.removed
+}
+
+// key hashes the key fields of flow. Only the hash is kept, so long
+// addresses and labels do not add to the memory used per flow.
+func (d *Deduplicator) key(flow Flow) ([16]byte, error) {
+	var key [16]byte
+	values, err := fieldValues(flow, d.fields)
+	if err != nil {
+		return key, err
+	}
+	hash := fnv.New128a()
+	for _, value := range values {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	copy(key[:], hash.Sum(nil))
+	return key, nil
+}
+
+// fieldValues returns the value of each field of flow, named as in
+// NewDeduplicator. Missing fields are empty.
+func fieldValues(flow Flow, fields []string) ([]string, error) {
+	values := make([]string, len(fields))
+	var flat map[string]fieldValue
+	for i, field := range fields {
+		if get, ok := flowFields[field]; ok {
+			values[i] = get(flow)
+			continue
+		}
+		if flat == nil {
+			var err error
+			if flat, err = flattenFlow(flow); err != nil {
+				return nil, err
+			}
+		}
+		values[i] = flat[field].text
+	}
+	return values, nil
+}
@@ -0,0 +1,130 @@
+package cloudsecure
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"testing"
+	"time"
+)
+
+// testFlow decodes a flow from 10.0.0.1 to 10.0.0.2 with the given port and
+// detection times
+func testFlow(t *testing.T, port int, start, end string) Flow {
+	t.Helper()
+	var flow Flow
+	data := fmt.Sprintf(`{"status": "ALLOWED", "src": {"ip_address": "10.0.0.1", "hostname": "web1"}, "dst": {"ip_address": "10.0.0.2"}, "dst_port": %d, "protocol": "TCP", "start_time": %q, "end_time": %q, "bytes": 100}`,
+		port, start, end)
+	if err := json.Unmarshal([]byte(data), &flow); err != nil {
+		t.Fatal(err)
+	}
+	return flow
+}
+
+func TestDeduplicatorKey(t *testing.T) {
+	d, err := NewDeduplicator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := testFlow(t, 443, "2026-01-01T00:10:00Z", "2026-01-01T00:20:00Z")
+	key, err := d.key(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// FNV-128a of the values of DefaultDedupKey, each followed by a zero byte
+	hash := fnv.New128a()
+	for _, value := range []string{"10.0.0.1", "10.0.0.2", "443", "TCP", "2026-01-01T00:10:00Z", "2026-01-01T00:20:00Z"} {
+		hash.Write([]byte(value + "\x00"))
+	}
+	if want := hash.Sum(nil); string(key[:]) != string(want) {
+		t.Errorf("key = %x, want %x", key, want)
+	}
+
+	// values are separated, so moving a character between fields changes the key
+	d, _ = NewDeduplicator([]string{"protocol", "status"})
+	a, _ := d.key(Flow{Protocol: "TC", Status: "PALLOWED"})
+	b, _ := d.key(Flow{Protocol: "TCP", Status: "ALLOWED"})
+	if a == b {
+		t.Error("keys of different field values are equal")
+	}
+
+	// dotted paths read the flow JSON
+	d, _ = NewDeduplicator([]string{"src.hostname"})
+	other := testFlow(t, 22, "2026-01-01T05:00:00Z", "2026-01-01T06:00:00Z")
+	if a, b := mustKey(t, d, flow), mustKey(t, d, other); a != b {
+		t.Error("flows with the same src.hostname have different keys")
+	}
+
+	if _, err := NewDeduplicator([]string{"src", " "}); err == nil {
+		t.Error("NewDeduplicator accepted an empty field")
+	}
+}
+
+func mustKey(t *testing.T, d *Deduplicator, flow Flow) [16]byte {
+	t.Helper()
+	key, err := d.key(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, err := NewDeduplicator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// active across the boundary at 01:00, so both segments return it
+	across := testFlow(t, 443, "2026-01-01T00:50:00Z", "2026-01-01T01:10:00Z")
+	early := testFlow(t, 22, "2026-01-01T00:10:00Z", "2026-01-01T00:20:00Z")
+
+	d.StartSegment(day)
+	for _, flow := range []Flow{across, early} {
+		if seen, err := d.Seen(flow); seen || err != nil {
+			t.Fatalf("first flow of the segment seen: %v, %v", seen, err)
+		}
+	}
+	if seen, _ := d.Seen(early); !seen {
+		t.Error("duplicate within a segment not dropped")
+	}
+
+	d.StartSegment(day.Add(time.Hour))
+	if seen, _ := d.Seen(across); !seen {
+		t.Error("duplicate across the segment boundary not dropped")
+	}
+	if d.Removed() != 2 {
+		t.Errorf("Removed = %d, want 2", d.Removed())
+	}
+	// early ended before the segment started, so it is no longer retained
+	if _, ok := d.seen[mustKey(t, d, early)]; ok {
+		t.Error("flow that ended before the segment is still retained")
+	}
+	if len(d.seen) != 1 {
+		t.Errorf("%d flows retained, want 1", len(d.seen))
+	}
+
+	d.StartSegment(day.Add(2 * time.Hour))
+	if len(d.seen) != 0 {
+		t.Errorf("%d flows retained after every flow ended, want 0", len(d.seen))
+	}
+}
+
+func TestDeduplicatorWindowWithoutEndTime(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, _ := NewDeduplicator(nil)
+	flow := testFlow(t, 443, "2026-01-01T00:10:00Z", "not a time")
+
+	d.StartSegment(day)
+	d.Seen(flow)
+	// a flow without a readable end time is kept for the next segment only
+	d.StartSegment(day.Add(time.Hour))
+	if seen, _ := d.Seen(flow); !seen {
+		t.Error("duplicate in the next segment not dropped")
+	}
+	d.StartSegment(day.Add(2 * time.Hour))
+	if len(d.seen) != 0 {
+		t.Errorf("%d flows retained two segments later, want 0", len(d.seen))
+	}
+}
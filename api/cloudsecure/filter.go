@@ -0,0 +1,114 @@
+package cloudsecure
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// FlowFilter selects flows by status, address, port and protocol. The flows
+// request only takes a period and max_results, so the filter is applied to
+// the flows as they are received: it shrinks the output, not the download.
+// Empty fields do not filter; the values of one field are alternatives and
+// the fields must all match.
+type FlowFilter struct {
+	Statuses        []string `json:"flow_status,omitempty"`
+	SrcCIDRs        []string `json:"src_ip,omitempty"`
+	DstCIDRs        []string `json:"dst_ip,omitempty"`
+	ExcludeSrcCIDRs []string `json:"exclude_src_ip,omitempty"`
+	ExcludeDstCIDRs []string `json:"exclude_dst_ip,omitempty"`
+	Ports           []int    `json:"dst_port,omitempty"`
+	Protocols       []string `json:"protocol,omitempty"`
+}
+
+// IsEmpty reports whether the filter lets every flow through
+func (f *FlowFilter) IsEmpty() bool {
+	return f == nil || len(f.Statuses) == 0 && len(f.SrcCIDRs) == 0 && len(f.DstCIDRs) == 0 &&
+		len(f.ExcludeSrcCIDRs) == 0 && len(f.ExcludeDstCIDRs) == 0 && len(f.Ports) == 0 && len(f.Protocols) == 0
+}
+
+// Normalize checks the filter and rewrites it in canonical form: statuses
+// and protocols in upper case, single addresses as /32 or /128 networks.
+func (f *FlowFilter) Normalize() error {
+	if f == nil {
+		return nil
+	}
+	for i, status := range f.Statuses {
+		f.Statuses[i] = strings.ToUpper(strings.TrimSpace(status))
+	}
+	for i, protocol := range f.Protocols {
+		f.Protocols[i] = strings.ToUpper(strings.TrimSpace(protocol))
+	}
+	for _, port := range f.Ports {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, list := range [][]string{f.SrcCIDRs, f.DstCIDRs, f.ExcludeSrcCIDRs, f.ExcludeDstCIDRs} {
+		for i, value := range list {
+			cidr, err := normalizeCIDR(value)
+			if err != nil {
+				return err
+			}
+			list[i] = cidr
+		}
+	}
+	return nil
+}
+
+// Match reports whether flow passes the filter
+func (f *FlowFilter) Match(flow Flow) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, strings.ToUpper(flow.Status)) {
+		return false
+	}
+	if len(f.Protocols) > 0 && !slices.Contains(f.Protocols, strings.ToUpper(flow.Protocol)) {
+		return false
+	}
+	if len(f.Ports) > 0 && !slices.Contains(f.Ports, flow.DstPort) {
+		return false
+	}
+	if len(f.SrcCIDRs) > 0 && !inCIDRs(flow.Src.IPAddress, f.SrcCIDRs) {
+		return false
+	}
+	if len(f.DstCIDRs) > 0 && !inCIDRs(flow.Dst.IPAddress, f.DstCIDRs) {
+		return false
+	}
+	if inCIDRs(flow.Src.IPAddress, f.ExcludeSrcCIDRs) || inCIDRs(flow.Dst.IPAddress, f.ExcludeDstCIDRs) {
+		return false
+	}
+	return true
+}
+
+// normalizeCIDR accepts a CIDR or a single address and returns it as a network
+func normalizeCIDR(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if _, ipNet, err := net.ParseCIDR(value); err == nil {
+		return ipNet.String(), nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP or CIDR: %s", value)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// inCIDRs reports whether ip is in any of cidrs
+func inCIDRs(ip string, cidrs []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
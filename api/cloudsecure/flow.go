@@ -0,0 +1,354 @@
+package cloudsecure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flow is one traffic flow as returned by the flows API
+type Flow struct {
+	Status    string
+	StartTime string
+	EndTime   string
+	Src       Endpoint
+	Dst       Endpoint
+	DstPort   int
+	Protocol  string
+	Bytes     int64
+
+	// Raw is the flow exactly as it was received
+	Raw json.RawMessage
+}
+
+// Endpoint is the source or destination of a flow
+type Endpoint struct {
+	// IPAddress is the IPv4 or IPv6 address of the endpoint, if it has one
+	IPAddress string
+
+	// Address identifies the endpoint: its IP address, or else its
+	// hostname, FQDN or cloud resource ID
+	Address string
+
+	// Type is the kind of Address, one of the EndpointType constants, or
+	// empty when the endpoint has no address
+	Type string
+
+	// Workload, Labels, VPC and Account describe the workload or cloud
+	// resource behind the endpoint, when the API sends them. Labels are
+	// written as key=value pairs separated by semicolons.
+	Workload string
+	Labels   string
+	VPC      string
+	Account  string
+
+	// Raw is the endpoint exactly as it was received
+	Raw json.RawMessage
+}
+
+// Endpoint types
+const (
+	EndpointIPv4          = "ipv4"
+	EndpointIPv6          = "ipv6"
+	EndpointHostname      = "hostname"
+	EndpointFQDN          = "fqdn"
+	EndpointCloudResource = "cloud_resource"
+	EndpointUnknown       = "unknown"
+)
+
+// endpointKeys are the endpoint fields that can identify it, most specific
+// first. Keys naming a cloud resource make its value a cloud resource ID.
+var endpointKeys = []struct {
+	key           string
+	cloudResource bool
+}{
+	{key: "ip_address"},
+	{key: "ip"},
+	{key: "ipv6_address"},
+	{key: "address"},
+	{key: "fqdn"},
+	{key: "dns_name"},
+	{key: "hostname"},
+	{key: "host"},
+	{key: "cloud_resource_id", cloudResource: true},
+	{key: "resource_id", cloudResource: true},
+	{key: "arn", cloudResource: true},
+	{key: "instance_id", cloudResource: true},
+	{key: "name"},
+}
+
+// UnmarshalJSON decodes a flow, accepting numbers and strings for scalar fields
+func (f *Flow) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Status    json.RawMessage `json:"status"`
+		StartTime json.RawMessage `json:"start_time"`
+		EndTime   json.RawMessage `json:"end_time"`
+		Src       Endpoint        `json:"src"`
+		Dst       Endpoint        `json:"dst"`
+		DstPort   json.RawMessage `json:"dst_port"`
+		Protocol  json.RawMessage `json:"protocol"`
+		Bytes     json.RawMessage `json:"bytes"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	port, err := scalarInt(fields.DstPort)
+	if err != nil {
+		return fmt.Errorf("invalid dst_port: %v", err)
+	}
+	byteCount, err := scalarInt(fields.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid bytes: %v", err)
+	}
+
+	*f = Flow{
+		Status:    scalarText(fields.Status),
+		StartTime: scalarText(fields.StartTime),
+		EndTime:   scalarText(fields.EndTime),
+		Src:       fields.Src,
+		Dst:       fields.Dst,
+		DstPort:   int(port),
+		Protocol:  scalarText(fields.Protocol),
+		Bytes:     byteCount,
+		Raw:       append(json.RawMessage(nil), data...),
+	}
+	return nil
+}
+
+// MarshalJSON returns the flow as it was received
+func (f Flow) MarshalJSON() ([]byte, error) {
+	if len(f.Raw) == 0 {
+		return []byte("null"), nil
+	}
+	return f.Raw, nil
+}
+
+// legacyFieldPattern matches the key:value pairs of endpoints sent as plain
+// text, such as "map[ip_address:10.0.0.1 hostname:web1]". Values may
+// contain colons, as IPv6 addresses do.
+var legacyFieldPattern = regexp.MustCompile(`([A-Za-z_]+):([^\s\]]+)`)
+
+// cloudResourcePattern matches cloud resource IDs: AWS ARNs and resource IDs,
+// Azure resource IDs and GCP resource names
+var cloudResourcePattern = regexp.MustCompile(`^(arn:|/subscriptions/|//[a-z]+\.googleapis\.com/|projects/[^/]+/)|^(i|eni|vpc|subnet|sg|vol|igw|nat|vpce)-[0-9a-f]{8,17}$`)
+
+// hostnamePattern matches a DNS name, one or more labels separated by dots
+var hostnamePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// UnmarshalJSON decodes an endpoint object, or a plain text endpoint
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	*e = Endpoint{Raw: append(json.RawMessage(nil), data...)}
+
+	fields := make(map[string]string)
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &object); err != nil {
+			return err
+		}
+		for key, value := range object {
+			fields[strings.ToLower(key)] = scalarText(value)
+		}
+		e.parseMetadata(trimmed)
+	} else {
+		text := scalarText(trimmed)
+		for _, match := range legacyFieldPattern.FindAllStringSubmatch(text, -1) {
+			fields[strings.ToLower(match[1])] = match[2]
+		}
+		if !hasEndpointKey(fields) {
+			// a bare address or name, which may itself contain colons
+			fields = map[string]string{"address": strings.TrimSpace(text)}
+		}
+	}
+
+	for _, candidate := range endpointKeys {
+		value := strings.TrimSpace(fields[candidate.key])
+		if value == "" {
+			continue
+		}
+		if candidate.cloudResource {
+			e.Address, e.Type = value, EndpointCloudResource
+			return nil
+		}
+		e.Address, e.Type = value, classifyAddress(value)
+		if e.Type == EndpointIPv4 || e.Type == EndpointIPv6 {
+			e.IPAddress = e.Address
+		}
+		return nil
+	}
+	return nil
+}
+
+// Paths of the endpoint metadata fields, most specific first
+var (
+	workloadPaths = []string{"workload.name", "workload.hostname", "workload_name", "workload", "vm_name", "instance_name"}
+	labelPaths    = []string{"labels", "workload.labels", "tags", "cloud.tags"}
+	vpcPaths      = []string{"vpc_id", "vpc.id", "vpc", "cloud.vpc_id", "network_id", "vnet_id", "network"}
+	accountPaths  = []string{"account_id", "account", "cloud_account_id", "cloud.account_id", "subscription_id", "project_id"}
+)
+
+// parseMetadata fills in the workload and cloud fields of an endpoint object
+func (e *Endpoint) parseMetadata(object json.RawMessage) {
+	fields := make(map[string]json.RawMessage)
+	var collect func(prefix string, raw json.RawMessage)
+	collect = func(prefix string, raw json.RawMessage) {
+		var members map[string]json.RawMessage
+		if json.Unmarshal(raw, &members) != nil {
+			return
+		}
+		for key, value := range members {
+			path := strings.ToLower(key)
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			fields[path] = value
+			collect(path, value)
+		}
+	}
+	collect("", object)
+
+	first := func(paths []string, format func(json.RawMessage) string) string {
+		for _, path := range paths {
+			if value := format(fields[path]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	scalar := func(value json.RawMessage) string {
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+			return ""
+		}
+		return scalarText(value)
+	}
+
+	e.Workload = first(workloadPaths, scalar)
+	e.Labels = first(labelPaths, formatLabels)
+	e.VPC = first(vpcPaths, scalar)
+	e.Account = first(accountPaths, scalar)
+}
+
+// formatLabels writes labels as key=value pairs separated by semicolons.
+// Labels may be an object of keys and values, or an array of objects with
+// key and value members; anything else is written as text.
+func formatLabels(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	switch value[0] {
+	case '{':
+		var object map[string]json.RawMessage
+		if json.Unmarshal(value, &object) != nil {
+			return ""
+		}
+		for key, v := range object {
+			pairs = append(pairs, key+"="+scalarText(v))
+		}
+		sort.Strings(pairs)
+	case '[':
+		var items []json.RawMessage
+		if json.Unmarshal(value, &items) != nil {
+			return ""
+		}
+		for _, item := range items {
+			var label struct {
+				Key   json.RawMessage `json:"key"`
+				Value json.RawMessage `json:"value"`
+			}
+			if json.Unmarshal(item, &label) != nil || label.Key == nil {
+				if text := scalarText(item); text != "" && !strings.HasPrefix(text, "{") {
+					pairs = append(pairs, text)
+				}
+				continue
+			}
+			pairs = append(pairs, scalarText(label.Key)+"="+scalarText(label.Value))
+		}
+	default:
+		return scalarText(value)
+	}
+	return strings.Join(pairs, ";")
+}
+
+// hasEndpointKey reports whether fields hold any of endpointKeys
+func hasEndpointKey(fields map[string]string) bool {
+	for _, candidate := range endpointKeys {
+		if _, ok := fields[candidate.key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyAddress returns the endpoint type of an address or name
+func classifyAddress(value string) string {
+	if addr, err := netip.ParseAddr(strings.Trim(value, "[]")); err == nil {
+		if addr.Is4() || addr.Is4In6() {
+			return EndpointIPv4
+		}
+		return EndpointIPv6
+	}
+	// the last label of a DNS name is never numeric, so such a name is a
+	// malformed IP address
+	name := strings.TrimSuffix(value, ".")
+	if _, err := strconv.Atoi(name[strings.LastIndex(name, ".")+1:]); err == nil {
+		return EndpointUnknown
+	}
+	switch {
+	case cloudResourcePattern.MatchString(value):
+		return EndpointCloudResource
+	case hostnamePattern.MatchString(value) && strings.Contains(strings.TrimSuffix(value, "."), "."):
+		return EndpointFQDN
+	case hostnamePattern.MatchString(value):
+		return EndpointHostname
+	}
+	return EndpointUnknown
+}
+
+// MarshalJSON returns the endpoint as it was received
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	if len(e.Raw) == 0 {
+		return []byte("null"), nil
+	}
+	return e.Raw, nil
+}
+
+// scalarText returns a JSON value as text: strings unquoted, null as empty,
+// anything else as its literal JSON
+func scalarText(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || string(value) == "null" {
+		return ""
+	}
+	if value[0] == '"' {
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			return s
+		}
+	}
+	return string(value)
+}
+
+// scalarInt parses a JSON number or numeric string, treating null as zero
+func scalarInt(value json.RawMessage) (int64, error) {
+	text := scalarText(value)
+	if text == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f), nil
+}
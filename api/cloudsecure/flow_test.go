@@ -0,0 +1,82 @@
+package cloudsecure
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEndpointAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		address   string
+		typ       string
+		ipAddress string
+	}{
+		{"ipv4", `{"ip_address": "10.0.0.1"}`, "10.0.0.1", EndpointIPv4, "10.0.0.1"},
+		{"ipv4 under ip", `{"ip": "192.168.5.10", "hostname": "web1"}`, "192.168.5.10", EndpointIPv4, "192.168.5.10"},
+		{"ipv4 mapped ipv6", `{"address": "::ffff:10.0.0.1"}`, "::ffff:10.0.0.1", EndpointIPv4, "::ffff:10.0.0.1"},
+		{"ipv6", `{"ipv6_address": "2001:db8::1"}`, "2001:db8::1", EndpointIPv6, "2001:db8::1"},
+		{"bracketed ipv6", `{"address": "[2001:db8::1]"}`, "[2001:db8::1]", EndpointIPv6, "[2001:db8::1]"},
+		{"hostname", `{"hostname": "web1"}`, "web1", EndpointHostname, ""},
+		{"fqdn", `{"fqdn": "db.example.com"}`, "db.example.com", EndpointFQDN, ""},
+		{"fqdn with root dot", `{"dns_name": "db.example.com."}`, "db.example.com.", EndpointFQDN, ""},
+		{"hostname before name", `{"name": "ignored", "host": "web-2"}`, "web-2", EndpointHostname, ""},
+		{"aws arn", `{"arn": "arn:aws:ec2:us-east-1:123456789012:instance/i-0abc"}`, "arn:aws:ec2:us-east-1:123456789012:instance/i-0abc", EndpointCloudResource, ""},
+		{"resource id key", `{"resource_id": "web1"}`, "web1", EndpointCloudResource, ""},
+		{"aws instance id", `{"address": "i-0123456789abcdef0"}`, "i-0123456789abcdef0", EndpointCloudResource, ""},
+		{"azure resource id", `{"address": "/subscriptions/1234/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1"}`,
+			"/subscriptions/1234/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", EndpointCloudResource, ""},
+		{"gcp resource name", `{"name": "//compute.googleapis.com/projects/p/zones/z/instances/vm1"}`,
+			"//compute.googleapis.com/projects/p/zones/z/instances/vm1", EndpointCloudResource, ""},
+		{"address trimmed", `{"ip_address": " 10.0.0.1 "}`, "10.0.0.1", EndpointIPv4, "10.0.0.1"},
+		{"empty value skipped", `{"ip_address": "", "hostname": "web1"}`, "web1", EndpointHostname, ""},
+		{"keys in any case", `{"IP_Address": "10.0.0.1"}`, "10.0.0.1", EndpointIPv4, "10.0.0.1"},
+
+		// plain text endpoints
+		{"bare ipv4", `"10.0.0.1"`, "10.0.0.1", EndpointIPv4, "10.0.0.1"},
+		{"bare ipv6", `"fe80::1"`, "fe80::1", EndpointIPv6, "fe80::1"},
+		{"bare fqdn", `"db.example.com"`, "db.example.com", EndpointFQDN, ""},
+		{"legacy map", `"map[ip_address:10.0.0.1 hostname:web1]"`, "10.0.0.1", EndpointIPv4, "10.0.0.1"},
+		{"legacy map ipv6", `"map[ip_address:2001:db8::1]"`, "2001:db8::1", EndpointIPv6, "2001:db8::1"},
+
+		// malformed addresses
+		{"ipv4 out of range", `{"address": "10.0.0.300"}`, "10.0.0.300", EndpointUnknown, ""},
+		{"digits in labels", `{"fqdn": "10.example.com"}`, "10.example.com", EndpointFQDN, ""},
+		{"ipv4 too short", `"10.0.1"`, "10.0.1", EndpointUnknown, ""},
+		{"invalid ipv6", `{"address": "2001:db8:::1"}`, "2001:db8:::1", EndpointUnknown, ""},
+		{"hostname with underscore", `{"hostname": "web_1"}`, "web_1", EndpointUnknown, ""},
+		{"hostname with leading hyphen", `{"hostname": "-web"}`, "-web", EndpointUnknown, ""},
+		{"empty label", `{"fqdn": "db..example.com"}`, "db..example.com", EndpointUnknown, ""},
+		{"numeric hostname", `{"hostname": "1234"}`, "1234", EndpointUnknown, ""},
+		{"spaces", `"not an address"`, "not an address", EndpointUnknown, ""},
+
+		// no address at all
+		{"empty object", `{}`, "", "", ""},
+		{"only metadata", `{"vpc_id": "vpc-1"}`, "", "", ""},
+		{"null", `null`, "", "", ""},
+		{"empty string", `""`, "", "", ""},
+	}
+	for _, tt := range tests {
+		var e Endpoint
+		if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if e.Address != tt.address || e.Type != tt.typ || e.IPAddress != tt.ipAddress {
+			t.Errorf("%s: address %q, type %q, IP address %q; want %q, %q, %q", tt.name, e.Address, e.Type, e.IPAddress, tt.address, tt.typ, tt.ipAddress)
+		}
+		if string(e.Raw) != tt.json {
+			t.Errorf("%s: Raw = %s, want the endpoint as received", tt.name, e.Raw)
+		}
+	}
+}
+
+func TestEndpointInvalidJSON(t *testing.T) {
+	for _, data := range []string{`{"ip_address": }`, `{"ip_address": "10.0.0.1"`, `{"ip_address": 10.0.0.1}`} {
+		var e Endpoint
+		if err := json.Unmarshal([]byte(data), &e); err == nil {
+			t.Errorf("decoding %s succeeded: %+v", data, e)
+		}
+	}
+}
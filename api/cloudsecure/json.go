@@ -0,0 +1,73 @@
+package cloudsecure
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// jsonRecordWriter writes each row as a JSON object with the column names
+// as keys, in column order. Rows are written one per line (NDJSON), or as
+// the elements of a single JSON array.
+type jsonRecordWriter struct {
+	w       *bufio.Writer
+	columns []Column
+	array   bool
+	rows    int
+}
+
+func (w *jsonRecordWriter) Write(record []string) error {
+	if len(record) != len(w.columns) {
+		return fmt.Errorf("record has %d values for %d columns", len(record), len(w.columns))
+	}
+
+	if w.array {
+		if w.rows == 0 {
+			w.w.WriteString("[\n")
+		} else {
+			w.w.WriteString(",\n")
+		}
+	}
+	w.w.WriteByte('{')
+	for i, column := range w.columns {
+		if i > 0 {
+			w.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(column.Name)
+		w.w.Write(key)
+		w.w.WriteByte(':')
+		w.w.Write(jsonValue(column, record[i]))
+	}
+	w.w.WriteByte('}')
+	if !w.array {
+		w.w.WriteByte('\n')
+	}
+	w.rows++
+	return nil
+}
+
+func (w *jsonRecordWriter) Close() error {
+	if w.array {
+		if w.rows == 0 {
+			w.w.WriteString("[")
+		}
+		w.w.WriteString("\n]\n")
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("error writing JSON: %v", err)
+	}
+	return nil
+}
+
+// jsonValue encodes one value of column
+func jsonValue(column Column, value string) []byte {
+	if column.Integer {
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return []byte(value)
+		}
+		return []byte("null")
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
@@ -0,0 +1,351 @@
+package cloudsecure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// parquetRowGroupSize is the number of rows buffered per Parquet row group
+const parquetRowGroupSize = 65536
+
+// Parquet enum values, from the parquet-format Thrift definitions
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetOptional = 1
+	parquetUTF8     = 0
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// parquetWriter writes rows as an uncompressed Parquet file. Every column is
+// optional: integer columns are INT64 and the others UTF8 strings. Rows are
+// written in row groups of parquetRowGroupSize, each column chunk as one
+// PLAIN encoded data page.
+type parquetWriter struct {
+	w       *bufio.Writer
+	columns []Column
+	offset  int64
+	err     error
+
+	// rows of the current row group, column by column
+	values [][]string
+	rows   int
+
+	rowGroups []parquetRowGroup
+	totalRows int64
+}
+
+// parquetRowGroup is the footer metadata of a written row group
+type parquetRowGroup struct {
+	chunks    []parquetChunk
+	rows      int64
+	totalSize int64
+}
+
+// parquetChunk is the footer metadata of a written column chunk
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+func newParquetWriter(w io.Writer, columns []Column) *parquetWriter {
+	p := &parquetWriter{
+		w:       bufio.NewWriter(w),
+		columns: columns,
+		values:  make([][]string, len(columns)),
+	}
+	p.write([]byte("PAR1"))
+	return p
+}
+
+func (p *parquetWriter) Write(record []string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(record) != len(p.columns) {
+		return fmt.Errorf("record has %d values for %d columns", len(record), len(p.columns))
+	}
+	for i, value := range record {
+		p.values[i] = append(p.values[i], value)
+	}
+	p.rows++
+	if p.rows >= parquetRowGroupSize {
+		p.flushRowGroup()
+	}
+	return p.err
+}
+
+func (p *parquetWriter) Close() error {
+	if p.rows > 0 {
+		p.flushRowGroup()
+	}
+	footer := p.footer()
+	p.write(footer)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	p.write(length[:])
+	p.write([]byte("PAR1"))
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+	if p.err != nil {
+		return fmt.Errorf("error writing Parquet: %v", p.err)
+	}
+	return nil
+}
+
+// write writes data and tracks the file offset, keeping the first error
+func (p *parquetWriter) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	p.err = err
+}
+
+// flushRowGroup writes the buffered rows as a row group
+func (p *parquetWriter) flushRowGroup() {
+	group := parquetRowGroup{rows: int64(p.rows)}
+	for i, column := range p.columns {
+		page := parquetPage(column, p.values[i])
+
+		header := newThriftWriter()
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(page)))
+		header.structField(5)
+		header.i32Field(1, int32(p.rows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetChunk{
+			offset: p.offset,
+			size:   int64(header.buf.Len() + len(page)),
+			values: int64(p.rows),
+		}
+		p.write(header.buf.Bytes())
+		p.write(page)
+		group.chunks = append(group.chunks, chunk)
+		group.totalSize += chunk.size
+		p.values[i] = p.values[i][:0]
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	p.totalRows += int64(p.rows)
+	p.rows = 0
+}
+
+// parquetPage encodes the definition levels and PLAIN values of a data page.
+// Empty values, and integer values that do not parse, are null.
+func parquetPage(column Column, values []string) []byte {
+	defined := make([]bool, len(values))
+	var data bytes.Buffer
+	for i, value := range values {
+		if column.Integer {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			binary.Write(&data, binary.LittleEndian, n)
+		} else {
+			if value == "" {
+				continue
+			}
+			binary.Write(&data, binary.LittleEndian, uint32(len(value)))
+			data.WriteString(value)
+		}
+		defined[i] = true
+	}
+
+	levels := rleBooleans(defined)
+	page := make([]byte, 4, 4+len(levels)+data.Len())
+	binary.LittleEndian.PutUint32(page, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, data.Bytes()...)
+}
+
+// rleBooleans encodes bit width 1 levels with the RLE/bit-packing hybrid,
+// as RLE runs only
+func rleBooleans(levels []bool) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		if levels[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// footer encodes the FileMetaData of the file
+func (p *parquetWriter) footer() []byte {
+	t := newThriftWriter()
+	t.i32Field(1, 1)
+
+	t.listField(2, thriftStruct, len(p.columns)+1)
+	t.beginStruct()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(p.columns)))
+	t.endStruct()
+	for _, column := range p.columns {
+		t.beginStruct()
+		if column.Integer {
+			t.i32Field(1, parquetInt64)
+		} else {
+			t.i32Field(1, parquetByteArray)
+		}
+		t.i32Field(3, parquetOptional)
+		t.stringField(4, column.Name)
+		if !column.Integer {
+			t.i32Field(6, parquetUTF8)
+		}
+		t.endStruct()
+	}
+
+	t.i64Field(3, p.totalRows)
+
+	t.listField(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		t.beginStruct()
+		t.listField(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			t.beginStruct()
+			t.i64Field(2, chunk.offset)
+			t.structField(3)
+			if column.Integer {
+				t.i32Field(1, parquetInt64)
+			} else {
+				t.i32Field(1, parquetByteArray)
+			}
+			t.listField(2, thriftI32, 2)
+			t.listI32(parquetPlain)
+			t.listI32(parquetRLE)
+			t.listField(3, thriftBinary, 1)
+			t.listString(column.Name)
+			t.i32Field(4, parquetUncompressed)
+			t.i64Field(5, chunk.values)
+			t.i64Field(6, chunk.size)
+			t.i64Field(7, chunk.size)
+			t.i64Field(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64Field(2, group.totalSize)
+		t.i64Field(3, group.rows)
+		t.endStruct()
+	}
+
+	t.stringField(6, "cs-traffic-filtering")
+	t.endStruct()
+	return t.buf.Bytes()
+}
+
+// Thrift compact protocol type ids
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs with the compact protocol, which is
+// how Parquet stores its metadata. Only the types Parquet metadata needs are
+// supported.
+type thriftWriter struct {
+	buf       bytes.Buffer
+	lastField []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{lastField: []int16{0}}
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &t.lastField[len(t.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64((v<<1)^(v>>63))))
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.listString(s)
+}
+
+// structField starts a struct valued field, ended with endStruct
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// listField starts a list valued field; the elements follow
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.buf.Write(binary.AppendUvarint(nil, uint64(size)))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listString(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
+
+// beginStruct starts a struct, as a list element or after structField
+func (t *thriftWriter) beginStruct() {
+	t.lastField = append(t.lastField, 0)
+}
+
+// endStruct writes the stop byte of the current struct
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastField = t.lastField[:len(t.lastField)-1]
+}
@@ -0,0 +1,264 @@
+package cloudsecure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// thriftReader decodes the Thrift compact protocol into generic values:
+// integers as int64, binaries as string, lists as []interface{} and structs
+// as map[int16]interface{} keyed by field id
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.data) {
+		panic("unexpected end of Thrift data")
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		panic("invalid varint")
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		fields := make(map[int16]interface{})
+		var last int16
+		for {
+			header := r.byte()
+			if header == 0 {
+				return fields
+			}
+			id := last + int16(header>>4)
+			if header>>4 == 0 {
+				id = int16(r.zigzag())
+			}
+			fields[id] = r.value(header & 0x0f)
+			last = id
+		}
+	}
+	panic(fmt.Sprintf("unsupported Thrift type %d", typ))
+}
+
+// field returns a nested field of a decoded struct by its path of ids
+func field(v interface{}, ids ...int16) interface{} {
+	for _, id := range ids {
+		v = v.(map[int16]interface{})[id]
+	}
+	return v
+}
+
+// readParquet decodes a file written by parquetWriter, returning the footer
+// and the rows, with nulls as empty strings
+func readParquet(t *testing.T, data []byte) (map[int16]interface{}, [][]string) {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatalf("missing PAR1 magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footerStart := len(data) - 8 - footerLen
+	r := &thriftReader{data: data[:len(data)-8], pos: footerStart}
+	footer := r.value(thriftStruct).(map[int16]interface{})
+	if r.pos != len(data)-8 {
+		t.Fatalf("footer is %d bytes, decoded %d", footerLen, r.pos-footerStart)
+	}
+
+	schema := footer[2].([]interface{})[1:]
+	var rows [][]string
+	for _, group := range footer[4].([]interface{}) {
+		numRows := int(field(group, 3).(int64))
+		groupRows := make([][]string, numRows)
+		for i := range groupRows {
+			groupRows[i] = make([]string, len(schema))
+		}
+		for c, chunk := range field(group, 1).([]interface{}) {
+			offset := int(field(chunk, 3, 9).(int64))
+			size := int(field(chunk, 3, 7).(int64))
+			page := &thriftReader{data: data[:offset+size], pos: offset}
+			header := page.value(thriftStruct)
+			if n := int(field(header, 5, 1).(int64)); n != numRows {
+				t.Fatalf("page has %d values in a row group of %d rows", n, numRows)
+			}
+			body := data[page.pos : page.pos+int(field(header, 2).(int64))]
+
+			// definition levels: RLE runs of bit width 1 after their length
+			levels := &thriftReader{data: body, pos: 4}
+			end := 4 + int(binary.LittleEndian.Uint32(body))
+			var defined []bool
+			for levels.pos < end {
+				run := int(levels.uvarint() >> 1)
+				value := levels.byte() == 1
+				for i := 0; i < run; i++ {
+					defined = append(defined, value)
+				}
+			}
+
+			values := body[end:]
+			integer := field(schema[c], 1).(int64) == parquetInt64
+			for i := range groupRows {
+				if !defined[i] {
+					continue
+				}
+				if integer {
+					groupRows[i][c] = strconv.FormatInt(int64(binary.LittleEndian.Uint64(values)), 10)
+					values = values[8:]
+				} else {
+					n := binary.LittleEndian.Uint32(values)
+					groupRows[i][c] = string(values[4 : 4+n])
+					values = values[4+n:]
+				}
+			}
+			if len(values) != 0 {
+				t.Fatalf("column %d has %d bytes left over", c, len(values))
+			}
+		}
+		rows = append(rows, groupRows...)
+	}
+	return footer, rows
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []Column{{Name: "Source_IP"}, {Name: "DestinationPort", Integer: true}, {Name: "Protocol"}}
+	records := [][]string{
+		{"10.0.0.1", "443", "TCP"},
+		{"", "53", "UDP"},
+		{"db.example.com", "not a port", ""},
+		{"10.0.0.2", "-1", "TCP"},
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewRecordWriter("parquet", &buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Write([]string{"too", "few"}); err == nil {
+		t.Error("writing a short record succeeded")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	footer, rows := readParquet(t, buf.Bytes())
+	if footer[3].(int64) != int64(len(records)) {
+		t.Errorf("num_rows = %d, want %d", footer[3], len(records))
+	}
+
+	schema := footer[2].([]interface{})
+	if got := field(schema[0], 5).(int64); got != int64(len(columns)) {
+		t.Errorf("schema root has %d children, want %d", got, len(columns))
+	}
+	for i, column := range columns {
+		element := schema[i+1]
+		wantType := int64(parquetByteArray)
+		if column.Integer {
+			wantType = parquetInt64
+		}
+		if field(element, 4) != column.Name || field(element, 1).(int64) != wantType || field(element, 3).(int64) != parquetOptional {
+			t.Errorf("schema element %d = %v, want optional %s of type %d", i, element, column.Name, wantType)
+		}
+		if _, utf8 := element.(map[int16]interface{})[6]; utf8 == column.Integer {
+			t.Errorf("schema element %s: UTF8 annotation is %v", column.Name, utf8)
+		}
+	}
+
+	// nulls read back as empty strings
+	want := [][]string{
+		{"10.0.0.1", "443", "TCP"},
+		{"", "53", "UDP"},
+		{"db.example.com", "", ""},
+		{"10.0.0.2", "-1", "TCP"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	columns := []Column{{Name: "ByteCount", Integer: true}}
+	var buf bytes.Buffer
+	writer, err := NewRecordWriter("parquet", &buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := parquetRowGroupSize + 10
+	for i := 0; i < total; i++ {
+		if err := writer.Write([]string{strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	footer, rows := readParquet(t, buf.Bytes())
+	if groups := len(footer[4].([]interface{})); groups != 2 {
+		t.Errorf("%d row groups, want 2", groups)
+	}
+	if len(rows) != total {
+		t.Fatalf("%d rows, want %d", len(rows), total)
+	}
+	for i, row := range rows {
+		if row[0] != strconv.Itoa(i) {
+			t.Fatalf("row %d = %q", i, row)
+		}
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewRecordWriter("parquet", &buf, FlowColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	footer, rows := readParquet(t, buf.Bytes())
+	if len(rows) != 0 || footer[3].(int64) != 0 || len(footer[2].([]interface{})) != len(FlowColumns)+1 {
+		t.Errorf("empty file: %d rows, footer %v", len(rows), footer)
+	}
+}
@@ -0,0 +1,65 @@
+package cloudsecure
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter paces requests. Wait blocks until a request may be sent or ctx is done.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket is a Limiter allowing a steady number of requests per minute
+// with bursts of up to burst requests. It is safe for use by several
+// goroutines, which are served in the order they call Wait.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket refilled at perMinute tokens a minute
+func NewTokenBucket(perMinute float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   perMinute / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes a token, waiting for one to become available if necessary
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	// reserve a token; a negative balance is the queue of earlier waiters
+	b.tokens--
+	if b.tokens >= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if err := sleepContext(ctx, wait); err != nil {
+		// give the reservation back
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
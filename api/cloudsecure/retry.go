@@ -0,0 +1,230 @@
+package cloudsecure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request is attempted again and how
+// long to wait before doing so
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failure
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after each failure
+	Multiplier float64
+	// Jitter randomises each wait by up to this fraction in either direction
+	Jitter float64
+	// MaxElapsed stops retrying once this much time has passed since the
+	// first attempt. Zero means no limit.
+	MaxElapsed time.Duration
+	// Logf, if not nil, is called with a message for every failed attempt
+	Logf func(format string, args ...interface{})
+}
+
+// DefaultRetryPolicy returns the retry policy used by the api tool
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxElapsed:     15 * time.Minute,
+	}
+}
+
+// Validate checks that the policy can be used
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxElapsed < 0 {
+		return fmt.Errorf("backoff durations cannot be negative")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// logf passes a message to p.Logf when it is set
+func (p RetryPolicy) logf(format string, args ...interface{}) {
+	if p.Logf != nil {
+		p.Logf(format, args...)
+	}
+}
+
+// Backoff returns the wait before attempt number attempt+1, given that
+// attempt attempts have failed so far
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	wait := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		wait *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// ErrorClass groups errors by how a retry should treat them
+type ErrorClass int
+
+const (
+	// ClassPermanent errors fail the same way every time, such as
+	// authentication or validation failures
+	ClassPermanent ErrorClass = iota
+	// ClassNetwork errors are connection failures, timeouts and broken responses
+	ClassNetwork
+	// ClassThrottled errors are 429 responses
+	ClassThrottled
+	// ClassServer errors are 5xx responses
+	ClassServer
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNetwork:
+		return "network"
+	case ClassThrottled:
+		return "throttled"
+	case ClassServer:
+		return "server"
+	default:
+		return "permanent"
+	}
+}
+
+// Retryable reports whether errors of this class are worth another attempt
+func (c ErrorClass) Retryable() bool {
+	return c != ClassPermanent
+}
+
+// StatusError is returned when the API answers with a status other than 200
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is the wait requested by a Retry-After header, zero if none
+	RetryAfter time.Duration
+	// Body is the start of the response body
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("request failed with status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("request failed with status code: %d: %s", e.StatusCode, e.Body)
+}
+
+// Classify returns the class of an error returned by a request
+func Classify(err error) ErrorClass {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return ClassThrottled
+		case statusErr.StatusCode == http.StatusRequestTimeout:
+			return ClassNetwork
+		case statusErr.StatusCode >= 500:
+			return ClassServer
+		default:
+			return ClassPermanent
+		}
+	}
+
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.As(err, &syntaxErr):
+		return ClassNetwork
+	}
+	return ClassPermanent
+}
+
+// WithRetry runs operation until it succeeds or policy gives up. Permanent
+// errors are returned at once, 429 responses wait at least as long as their
+// Retry-After header asks, and nothing is retried once ctx is done.
+func WithRetry[T any](ctx context.Context, policy RetryPolicy, operation func() (T, error)) (T, error) {
+	var zero T
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		result, err := operation()
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return zero, fmt.Errorf("gave up after %d attempts: %w", attempt, ctx.Err())
+		}
+
+		class := Classify(err)
+		if !class.Retryable() {
+			policy.logf("Attempt %d failed with a %s error, not retrying: %v", attempt, class, err)
+			return zero, err
+		}
+		if attempt >= policy.MaxAttempts {
+			policy.logf("Attempt %d failed with a %s error, no attempts left: %v", attempt, class, err)
+			return zero, fmt.Errorf("all %d attempts failed, last error: %w", attempt, err)
+		}
+
+		wait := policy.Backoff(attempt)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			policy.logf("Attempt %d failed with a %s error, retrying in %v would exceed %v: %v", attempt, class, wait.Round(time.Millisecond), policy.MaxElapsed, err)
+			return zero, fmt.Errorf("gave up after %d attempts in %v, last error: %w", attempt, time.Since(start).Round(time.Second), err)
+		}
+
+		policy.logf("Attempt %d failed with a %s error, retrying in %v: %v", attempt, class, wait.Round(time.Millisecond), err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return zero, fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
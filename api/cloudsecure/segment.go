@@ -0,0 +1,177 @@
+package cloudsecure
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// nearLimitPercent is how close to max_results a segment has to come before
+// it is treated as truncated
+const nearLimitPercent = 99
+
+// SegmentOptions controls how a time range is divided into request windows
+type SegmentOptions struct {
+	MaxResults int
+	Initial    time.Duration
+	Min        time.Duration
+	Max        time.Duration
+	// Logf, if not nil, is called with a message for every split window
+	Logf func(format string, args ...interface{})
+}
+
+// DefaultSegmentOptions returns the segmentation used by the api tool
+func DefaultSegmentOptions() SegmentOptions {
+	return SegmentOptions{
+		MaxResults: 10000000,
+		Initial:    2 * time.Hour,
+		Min:        time.Minute,
+		Max:        24 * time.Hour,
+	}
+}
+
+// Validate checks that the options describe a usable segmentation
+func (o SegmentOptions) Validate() error {
+	if o.MaxResults <= 0 {
+		return fmt.Errorf("max results must be positive")
+	}
+	if o.Min < time.Second {
+		return fmt.Errorf("minimum segment must be at least 1s")
+	}
+	if o.Initial < o.Min || o.Initial > o.Max {
+		return fmt.Errorf("segment size %v must be between %v and %v", o.Initial, o.Min, o.Max)
+	}
+	return nil
+}
+
+// Segment is one request window, From inclusive and To exclusive
+type Segment struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func (s Segment) String() string {
+	return s.From.Format(time.RFC3339) + " to " + s.To.Format(time.RFC3339)
+}
+
+// SegmentPlanner hands out consecutive windows over one or more ranges.
+// Windows that come back truncated are split in half and queued again; the
+// size of new windows shrinks after truncation and grows after quiet windows.
+// It is safe for use by several goroutines.
+type SegmentPlanner struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	opts     SegmentOptions
+	ranges   []Segment
+	size     time.Duration
+	pending  []Segment
+	inFlight int
+	err      error
+}
+
+// NewSegmentPlanner returns a planner covering [start, end)
+func NewSegmentPlanner(start, end time.Time, opts SegmentOptions) *SegmentPlanner {
+	return NewSegmentPlannerFor([]Segment{{From: start, To: end}}, opts)
+}
+
+// NewSegmentPlannerFor returns a planner covering each of ranges in order
+func NewSegmentPlannerFor(ranges []Segment, opts SegmentOptions) *SegmentPlanner {
+	p := &SegmentPlanner{
+		opts:   opts,
+		ranges: append([]Segment(nil), ranges...),
+		size:   opts.Initial,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Next returns the next window to fetch. It blocks while other windows are in
+// flight and may still be split, and returns false once the range is covered
+// or a window has failed.
+func (p *SegmentPlanner) Next() (Segment, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.err != nil {
+			return Segment{}, false
+		}
+		if len(p.pending) > 0 {
+			seg := p.pending[0]
+			p.pending = p.pending[1:]
+			p.inFlight++
+			return seg, true
+		}
+		for len(p.ranges) > 0 && !p.ranges[0].From.Before(p.ranges[0].To) {
+			p.ranges = p.ranges[1:]
+		}
+		if len(p.ranges) > 0 {
+			current := &p.ranges[0]
+			to := current.From.Add(p.size)
+			if to.After(current.To) {
+				to = current.To
+			}
+			seg := Segment{From: current.From, To: to}
+			current.From = to
+			p.inFlight++
+			return seg, true
+		}
+		if p.inFlight == 0 {
+			return Segment{}, false
+		}
+		p.cond.Wait()
+	}
+}
+
+// IsTruncated reports whether a result count is at or near max_results
+func (p *SegmentPlanner) IsTruncated(count int) bool {
+	return count >= p.opts.MaxResults-p.opts.MaxResults*(100-nearLimitPercent)/100
+}
+
+// ShouldSplit reports whether seg has to be fetched again as two halves
+func (p *SegmentPlanner) ShouldSplit(seg Segment, count int) bool {
+	return p.IsTruncated(count) && seg.To.Sub(seg.From) >= 2*p.opts.Min
+}
+
+// Done records the outcome of a window handed out by Next
+func (p *SegmentPlanner) Done(seg Segment, count int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.cond.Broadcast()
+
+	p.inFlight--
+	if err != nil {
+		if p.err == nil {
+			p.err = fmt.Errorf("segment %s failed: %v", seg, err)
+		}
+		return
+	}
+
+	length := seg.To.Sub(seg.From)
+	switch {
+	case p.ShouldSplit(seg, count):
+		half := (length / 2).Truncate(time.Second)
+		mid := seg.From.Add(half)
+		if p.opts.Logf != nil {
+			p.opts.Logf("Segment %s returned %d flows (limit %d), splitting at %s",
+				seg, count, p.opts.MaxResults, mid.Format(time.RFC3339))
+		}
+		p.pending = append(p.pending, Segment{From: seg.From, To: mid}, Segment{From: mid, To: seg.To})
+		if half < p.size {
+			p.size = half
+		}
+	case count < p.opts.MaxResults/4 && length >= p.size && p.size < p.opts.Max:
+		// quiet window, try a wider one next
+		p.size *= 2
+		if p.size > p.opts.Max {
+			p.size = p.opts.Max
+		}
+	}
+}
+
+// Err returns the first failure reported to Done
+func (p *SegmentPlanner) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -0,0 +1,116 @@
+package cloudsecure
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// Formats are the output formats supported by NewRecordWriter
+var Formats = []string{"csv", "ndjson", "json", "parquet"}
+
+// Column is one column of an output file
+type Column struct {
+	Name string
+
+	// Integer columns are written as numbers by the JSON and Parquet
+	// writers; values that are not integers are written as null
+	Integer bool
+}
+
+// FlowColumns are the columns of Flow.Record
+var FlowColumns = []Column{
+	{Name: "FlowStatus"},
+	{Name: "FirstDetected"},
+	{Name: "LastDetected"},
+	{Name: "Source_IP"},
+	{Name: "Destination_IP"},
+	{Name: "DestinationPort", Integer: true},
+	{Name: "Protocol"},
+	{Name: "ByteCount", Integer: true},
+	{Name: "Source_EndpointType"},
+	{Name: "Destination_EndpointType"},
+}
+
+// RecordWriter writes rows with one value per column in an output format
+type RecordWriter interface {
+	// Write writes one row
+	Write(record []string) error
+
+	// Close completes the output and flushes it to the underlying writer,
+	// which it does not close
+	Close() error
+}
+
+// NewRecordWriter returns a RecordWriter for format writing to w. The CSV
+// writer writes the column names as its first row.
+func NewRecordWriter(format string, w io.Writer, columns []Column) (RecordWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVRecordWriter(w, columns)
+	case "ndjson":
+		return &jsonRecordWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	case "json":
+		return &jsonRecordWriter{w: bufio.NewWriter(w), columns: columns, array: true}, nil
+	case "parquet":
+		return newParquetWriter(w, columns), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected one of %v", format, Formats)
+}
+
+// AppendFormats are the formats whose files can be extended with
+// NewAppendRecordWriter
+var AppendFormats = []string{"csv", "ndjson"}
+
+// NewAppendRecordWriter returns a RecordWriter adding rows to output that
+// already holds rows of the same columns. The CSV writer does not repeat the
+// column names.
+func NewAppendRecordWriter(format string, w io.Writer, columns []Column) (RecordWriter, error) {
+	switch format {
+	case "csv":
+		return &csvRecordWriter{writer: csv.NewWriter(w)}, nil
+	case "ndjson":
+		return &jsonRecordWriter{w: bufio.NewWriter(w), columns: columns}, nil
+	}
+	return nil, fmt.Errorf("cannot append to %s output, expected one of %v", format, AppendFormats)
+}
+
+// FormatExtension returns the file extension used for format
+func FormatExtension(format string) string {
+	return "." + format
+}
+
+// columnNames returns the names of columns
+func columnNames(columns []Column) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// csvRecordWriter is the RecordWriter for CSV
+type csvRecordWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVRecordWriter(w io.Writer, columns []Column) (*csvRecordWriter, error) {
+	writer := &csvRecordWriter{writer: csv.NewWriter(w)}
+	if err := writer.Write(columnNames(columns)); err != nil {
+		return nil, fmt.Errorf("error writing CSV header: %v", err)
+	}
+	return writer, nil
+}
+
+func (w *csvRecordWriter) Write(record []string) error {
+	if err := w.writer.Write(record); err != nil {
+		return fmt.Errorf("error writing CSV record: %v", err)
+	}
+	return nil
+}
+
+func (w *csvRecordWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
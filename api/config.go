@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+	"github.com/csmanutd/csutils"
+)
+
+// Config is the content of csconfig.json: the CloudSecure tenants managed by
+// csutils plus the fetcher settings stored alongside them
+type Config struct {
+	csutils.CloudSecureConfig
+	Settings
+
+	// dataKey encrypts the secret fields when Encryption is set
+	dataKey []byte
+}
+
+// Settings are the fetcher options kept in csconfig.json next to the tenants
+type Settings struct {
+	Retry      *RetrySettings            `json:"retry,omitempty"`
+	RateLimit  *RateLimitSettings        `json:"rate_limit,omitempty"`
+	Connection *ConnectionSettings       `json:"connection,omitempty"`
+	Columns    []cloudsecure.ColumnSpec  `json:"columns,omitempty"`
+	Tenants    map[string]TenantSettings `json:"tenant_settings,omitempty"`
+
+	// Schedule is the cron expression of serve for tenants without their own
+	Schedule string `json:"schedule,omitempty"`
+
+	// Encryption is set when the secret fields are encrypted
+	Encryption *EncryptionSettings `json:"encryption,omitempty"`
+}
+
+// TenantSettings are the settings of one tenant, keyed by CloudSecure name
+type TenantSettings struct {
+	RateLimit  *RateLimitSettings  `json:"rate_limit,omitempty"`
+	Connection *ConnectionSettings `json:"connection,omitempty"`
+	Schedule   string              `json:"schedule,omitempty"`
+}
+
+// ConnectionSettings describe how the CloudSecure API is reached. Settings of
+// a tenant override the global ones field by field.
+type ConnectionSettings struct {
+	BaseURL    string `json:"base_url,omitempty"`
+	Proxy      string `json:"proxy,omitempty"`
+	CAFile     string `json:"ca_file,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+}
+
+// Merge returns c with the fields set in override replaced
+func (c *ConnectionSettings) Merge(override *ConnectionSettings) *ConnectionSettings {
+	var merged ConnectionSettings
+	if c != nil {
+		merged = *c
+	}
+	if override == nil {
+		return &merged
+	}
+	if override.BaseURL != "" {
+		merged.BaseURL = override.BaseURL
+	}
+	if override.Proxy != "" {
+		merged.Proxy = override.Proxy
+	}
+	if override.CAFile != "" {
+		merged.CAFile = override.CAFile
+	}
+	if override.ClientCert != "" {
+		merged.ClientCert = override.ClientCert
+	}
+	if override.ClientKey != "" {
+		merged.ClientKey = override.ClientKey
+	}
+	return &merged
+}
+
+// Endpoint returns the base URL and HTTP client described by the settings
+func (c *ConnectionSettings) Endpoint() (cloudsecure.APIEndpoint, error) {
+	if c == nil {
+		return cloudsecure.APIEndpoint{}, nil
+	}
+	httpClient, err := cloudsecure.NewHTTPClient(cloudsecure.TransportOptions{
+		ProxyURL:       c.Proxy,
+		CAFile:         c.CAFile,
+		ClientCertFile: c.ClientCert,
+		ClientKeyFile:  c.ClientKey,
+	})
+	if err != nil {
+		return cloudsecure.APIEndpoint{}, err
+	}
+	return cloudsecure.APIEndpoint{BaseURL: c.BaseURL, HTTPClient: httpClient}, nil
+}
+
+// RateLimitSettings describe a token bucket limiter
+type RateLimitSettings struct {
+	RequestsPerMinute float64 `json:"requests_per_minute"`
+	Burst             int     `json:"burst,omitempty"`
+}
+
+// Limiter returns the configured limiter, or nil when no limit is set
+func (r *RateLimitSettings) Limiter() cloudsecure.Limiter {
+	if r == nil || r.RequestsPerMinute <= 0 {
+		return nil
+	}
+	return cloudsecure.NewTokenBucket(r.RequestsPerMinute, r.Burst)
+}
+
+// RetrySettings overrides parts of the default retry policy. Durations are
+// written as Go durations, e.g. "2s" or "15m".
+type RetrySettings struct {
+	MaxAttempts    int      `json:"max_attempts,omitempty"`
+	InitialBackoff Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+	Multiplier     float64  `json:"multiplier,omitempty"`
+	Jitter         *float64 `json:"jitter,omitempty"`
+	MaxElapsed     Duration `json:"max_elapsed,omitempty"`
+}
+
+// Apply copies the configured values onto policy
+func (r *RetrySettings) Apply(policy *cloudsecure.RetryPolicy) {
+	if r == nil {
+		return
+	}
+	if r.MaxAttempts != 0 {
+		policy.MaxAttempts = r.MaxAttempts
+	}
+	if r.InitialBackoff != 0 {
+		policy.InitialBackoff = time.Duration(r.InitialBackoff)
+	}
+	if r.MaxBackoff != 0 {
+		policy.MaxBackoff = time.Duration(r.MaxBackoff)
+	}
+	if r.Multiplier != 0 {
+		policy.Multiplier = r.Multiplier
+	}
+	if r.Jitter != nil {
+		policy.Jitter = *r.Jitter
+	}
+	if r.MaxElapsed != 0 {
+		policy.MaxElapsed = time.Duration(r.MaxElapsed)
+	}
+}
+
+// Duration is a time.Duration stored in JSON as a string such as "90s"
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig read config from json file. Encrypted secret fields are
+// decrypted with key. The file is read directly rather than through csutils,
+// which prompts for a tenant and creates the file when it is missing; a
+// missing file is returned as an error satisfying os.IsNotExist.
+func LoadConfig(fileName string, key configKey) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config.CloudSecureConfig); err != nil {
+		return config, fmt.Errorf("error reading %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(data, &config.Settings); err != nil {
+		return config, fmt.Errorf("error reading settings from %s: %v", fileName, err)
+	}
+	if config.Encryption != nil {
+		if config.dataKey, err = unwrapDataKey(config.Encryption, key); err != nil {
+			return config, fmt.Errorf("error decrypting %s: %v", fileName, err)
+		}
+		if err := decryptSecrets(&config.CloudSecureConfig, config.dataKey); err != nil {
+			return config, fmt.Errorf("error decrypting %s: %v", fileName, err)
+		}
+	}
+	return config, nil
+}
+
+// SaveConfig save config to json file. The tenants and settings are
+// written together through a temporary file readable only by the owner, so
+// that a crash never leaves the file without its tenants or its data key.
+// With encryption the secret fields are encrypted first.
+func SaveConfig(fileName string, config Config) error {
+	tenants := config.CloudSecureConfig
+	if config.Encryption != nil {
+		if config.dataKey == nil {
+			return fmt.Errorf("no data key to encrypt %s", fileName)
+		}
+		var err error
+		if tenants, err = encryptSecrets(tenants, config.dataKey); err != nil {
+			return err
+		}
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for _, part := range []interface{}{tenants, config.Settings} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, data, 0600)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runConfigCommand implements the config subcommand, which encrypts,
+// decrypts or changes the key of the secret fields of csconfig.json
+func runConfigCommand(args []string, configFileName string) error {
+	usage := func(output *os.File) {
+		fmt.Fprintf(output, "Usage: api config encrypt|decrypt|rekey [options]\n\n")
+		fmt.Fprintf(output, "  encrypt  encrypt api_key and api_secret of every tenant\n")
+		fmt.Fprintf(output, "  decrypt  store them in clear text again\n")
+		fmt.Fprintf(output, "  rekey    encrypt them under a new data key and passphrase or key file\n\n")
+	}
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return fmt.Errorf("missing config command")
+	}
+	command := args[0]
+	if command != "encrypt" && command != "decrypt" && command != "rekey" {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown config command %q", command)
+	}
+
+	fs := flag.NewFlagSet("config "+command, flag.ExitOnError)
+	configKeyFile := fs.String("config-key-file", "", "Key file of the encrypted csconfig.json, defaults to CS_CONFIG_KEY_FILE")
+	keyFile := fs.String("key-file", "", "Key file to encrypt with instead of a passphrase (32 bytes, raw, hex or base64)")
+	fs.Usage = func() {
+		usage(os.Stderr)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	config, err := LoadConfig(configFileName, configKeyFromEnv(*configKeyFile, true))
+	if err != nil {
+		return fmt.Errorf("error loading %s: %v", configFileName, err)
+	}
+
+	switch {
+	case command == "encrypt" && config.Encryption != nil:
+		return fmt.Errorf("%s is already encrypted, use config rekey to change the key", configFileName)
+	case command != "encrypt" && config.Encryption == nil:
+		return fmt.Errorf("%s is not encrypted, use config encrypt", configFileName)
+	}
+
+	if command == "decrypt" {
+		config.Encryption, config.dataKey = nil, nil
+	} else {
+		// the new passphrase comes from CS_CONFIG_NEW_PASSPHRASE when rekeying,
+		// as CS_CONFIG_PASSPHRASE holds the current one
+		newKey := configKey{KeyFile: *keyFile, Passphrase: os.Getenv("CS_CONFIG_PASSPHRASE"), Interactive: true}
+		if command == "rekey" {
+			newKey.Passphrase = os.Getenv("CS_CONFIG_NEW_PASSPHRASE")
+		}
+		if config.Encryption, config.dataKey, err = newEncryption(newKey); err != nil {
+			return err
+		}
+	}
+	if err := SaveConfig(configFileName, config); err != nil {
+		return fmt.Errorf("error saving %s: %v", configFileName, err)
+	}
+
+	switch command {
+	case "decrypt":
+		fmt.Printf("Secrets of %d tenants in %s are stored in clear text\n", len(config.CloudSecures), configFileName)
+	default:
+		fmt.Printf("Secrets of %d tenants in %s are encrypted (%s)\n", len(config.CloudSecures), configFileName, config.Encryption.KDF)
+	}
+	return nil
+}
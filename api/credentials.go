@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/csmanutd/csutils"
+)
+
+// defaultSecretsDir is where secret files are looked for without -secrets-dir
+const defaultSecretsDir = "/run/secrets/cloudsecure"
+
+// keyringService is the service the credentials are stored under in the OS keyring
+const keyringService = "cs-traffic-filtering"
+
+// credentialFields are the fields of a tenant's credentials, named as in
+// csconfig.json
+var credentialFields = []string{"api_key", "api_secret", "tenant_id"}
+
+// credentialSource supplies some or all of the credentials of a tenant
+type credentialSource interface {
+	// Name describes the source in messages
+	Name() string
+
+	// Lookup returns the value of a credential field of tenant, or empty
+	// when the source does not have it
+	Lookup(tenant, field string) (string, error)
+
+	// Tenants returns the tenants the source knows of by name
+	Tenants() ([]string, error)
+}
+
+// credentialSources returns the sources consulted before csconfig.json, in
+// order: the environment, secret files in secretsDir and, with keyring, the
+// OS keyring. defaultName is the tenant of the unscoped environment variables.
+// The keyring runs a command for every lookup, so it is only asked for the
+// tenants in selected, or for every tenant when selected is nil, and left out
+// when its command is not installed.
+func credentialSources(secretsDir, defaultName string, keyring bool, selected []string) []credentialSource {
+	sources := []credentialSource{
+		envSource{defaultName: defaultName},
+		fileSource{dir: secretsDir},
+	}
+	if keyring {
+		if source, ok := newKeyringSource(selected); ok {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// resolveCloudSecures returns the tenants of config, of the sources and of
+// names, with every credential field taken from the first source that has
+// it and from config last. config itself is not changed, so secrets from
+// other sources are never written to csconfig.json.
+func resolveCloudSecures(config csutils.CloudSecureConfig, sources []credentialSource, names []string) (csutils.CloudSecureConfig, error) {
+	resolved := csutils.CloudSecureConfig{
+		CloudSecures:     make(map[string]csutils.CloudSecureInfo),
+		DefaultCloudName: config.DefaultCloudName,
+	}
+
+	// known holds every tenant to look up, and whether it is kept when no
+	// source has credentials for it
+	known := make(map[string]bool)
+	for name := range config.CloudSecures {
+		known[name] = true
+	}
+	for _, source := range sources {
+		tenants, err := source.Tenants()
+		if err != nil {
+			return resolved, fmt.Errorf("error reading %s: %v", source.Name(), err)
+		}
+		for _, name := range tenants {
+			known[name] = true
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := known[name]; !ok && name != "all" {
+			known[name] = false
+		}
+	}
+
+	for name, keep := range known {
+		if name == "" {
+			// an unnamed tenant, such as one saved by an empty prompt,
+			// cannot be selected
+			continue
+		}
+		info, found, err := lookupCredentials(name, config.CloudSecures[name], sources)
+		if err != nil {
+			return resolved, err
+		}
+		// tenants only named on the command line, such as those of scoped
+		// environment variables, exist when a source has them
+		if keep || found {
+			resolved.CloudSecures[name] = info
+		}
+	}
+
+	if resolved.DefaultCloudName == "" && len(resolved.CloudSecures) == 1 {
+		for name := range resolved.CloudSecures {
+			resolved.DefaultCloudName = name
+		}
+	}
+	return resolved, nil
+}
+
+// lookupCredentials fills in the credential fields of tenant from the
+// sources, keeping the fields of info that no source has. Each field is
+// taken from the first source that has it, and the sources after the one
+// that completes the credentials are not asked. found reports whether any
+// source had a field.
+func lookupCredentials(tenant string, info csutils.CloudSecureInfo, sources []credentialSource) (csutils.CloudSecureInfo, bool, error) {
+	values := map[string]*string{"api_key": &info.APIKey, "api_secret": &info.APISecret, "tenant_id": &info.TenantID}
+	resolved := make(map[string]bool)
+	for _, source := range sources {
+		for _, field := range credentialFields {
+			if resolved[field] {
+				continue
+			}
+			value, err := source.Lookup(tenant, field)
+			if err != nil {
+				return info, false, fmt.Errorf("error reading %s of %s from %s: %v", field, tenant, source.Name(), err)
+			}
+			if value != "" {
+				*values[field] = value
+				resolved[field] = true
+			}
+		}
+		if len(resolved) == len(credentialFields) {
+			break
+		}
+	}
+	return info, len(resolved) > 0, nil
+}
+
+// missingCredentials returns the credential fields of info that are empty
+func missingCredentials(info csutils.CloudSecureInfo) []string {
+	var missing []string
+	for i, value := range []string{info.APIKey, info.APISecret, info.TenantID} {
+		if value == "" {
+			missing = append(missing, credentialFields[i])
+		}
+	}
+	return missing
+}
+
+// envSource reads CS_<TENANT>_API_KEY, CS_<TENANT>_API_SECRET and
+// CS_<TENANT>_TENANT_ID, with the tenant name in upper case and other
+// characters than letters and digits replaced by underscores. The unscoped
+// CS_API_KEY, CS_API_SECRET and CS_TENANT_ID belong to the default tenant.
+// Every variable can also be given as a file path in <variable>_FILE.
+type envSource struct {
+	defaultName string
+}
+
+func (s envSource) Name() string {
+	return "the environment"
+}
+
+func (s envSource) Lookup(tenant, field string) (string, error) {
+	names := []string{envName(tenant, field)}
+	if tenant == s.defaultName {
+		names = append(names, envName("", field))
+	}
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value, nil
+		}
+		if path := os.Getenv(name + "_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	return "", nil
+}
+
+func (s envSource) Tenants() ([]string, error) {
+	for _, field := range credentialFields {
+		name := envName("", field)
+		if os.Getenv(name) != "" || os.Getenv(name+"_FILE") != "" {
+			return []string{s.defaultName}, nil
+		}
+	}
+	return nil, nil
+}
+
+// envName returns the environment variable of a credential field of tenant,
+// or the unscoped one when tenant is empty
+func envName(tenant, field string) string {
+	if tenant == "" {
+		return "CS_" + strings.ToUpper(field)
+	}
+	scoped := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, tenant)
+	return "CS_" + scoped + "_" + strings.ToUpper(field)
+}
+
+// fileSource reads <dir>/<tenant>/api_key, api_secret and tenant_id, as
+// mounted by Docker or Kubernetes secrets. A missing directory is empty.
+type fileSource struct {
+	dir string
+}
+
+func (s fileSource) Name() string {
+	return "secret files in " + s.dir
+}
+
+func (s fileSource) Lookup(tenant, field string) (string, error) {
+	if s.dir == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, tenant, field))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s fileSource) Tenants() ([]string, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, entry := range entries {
+		// Kubernetes mounts secrets through hidden ..data directories
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			tenants = append(tenants, entry.Name())
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// keyringSource reads the OS keyring through secret-tool on Linux and
+// security on macOS. Entries are stored under the service
+// cs-traffic-filtering with the tenant and field as attributes on Linux,
+// or the account <tenant>/<field> on macOS. Entries that cannot be read are
+// treated as missing, and so are the tenants not in tenants unless it is nil.
+type keyringSource struct {
+	command string
+	tenants map[string]bool
+}
+
+// newKeyringSource returns the keyring source for the tenants in selected,
+// or for every tenant when selected is nil. ok is false when the keyring
+// command of the OS is not installed.
+func newKeyringSource(selected []string) (source keyringSource, ok bool) {
+	name := "secret-tool"
+	if runtime.GOOS == "darwin" {
+		name = "security"
+	}
+	command, err := exec.LookPath(name)
+	if err != nil {
+		return source, false
+	}
+	source.command = command
+	if selected != nil {
+		source.tenants = make(map[string]bool)
+		for _, tenant := range selected {
+			source.tenants[tenant] = true
+		}
+	}
+	return source, true
+}
+
+func (keyringSource) Name() string {
+	return "the OS keyring"
+}
+
+func (s keyringSource) Lookup(tenant, field string) (string, error) {
+	if s.tenants != nil && !s.tenants[tenant] {
+		return "", nil
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command(s.command, "find-generic-password", "-s", keyringService, "-a", tenant+"/"+field, "-w")
+	default:
+		cmd = exec.Command(s.command, "lookup", "service", keyringService, "tenant", tenant, "field", field)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (keyringSource) Tenants() ([]string, error) {
+	return nil, nil
+}
+
+// resolveConfig returns the tenants of config merged with the environment,
+// the secret files in secretsDir and, with keyring, the OS keyring. names are
+// the tenants given with -cs; the keyring is only asked for those, or for the
+// default tenant without -cs.
+func resolveConfig(config Config, secretsDir string, keyring bool, names []string) (csutils.CloudSecureConfig, error) {
+	defaultName := os.Getenv("CS_NAME")
+	if defaultName == "" {
+		defaultName = config.DefaultCloudName
+	}
+	if defaultName == "" {
+		defaultName = "default"
+	}
+	selected := names
+	switch {
+	case slices.Contains(names, "all"):
+		selected = nil
+	case len(names) == 0:
+		selected = []string{defaultName}
+		// a single tenant is the default one when none is set
+		if config.DefaultCloudName == "" && len(config.CloudSecures) == 1 {
+			for name := range config.CloudSecures {
+				selected = append(selected, name)
+			}
+		}
+	}
+	sources := credentialSources(secretsDir, defaultName, keyring, selected)
+	resolved, err := resolveCloudSecures(config.CloudSecureConfig, sources, names)
+	if name := os.Getenv("CS_NAME"); name != "" {
+		resolved.DefaultCloudName = name
+	}
+	return resolved, err
+}
+
+// secretsDirDefault returns CS_SECRETS_DIR, or defaultSecretsDir when unset
+func secretsDirDefault() string {
+	if dir := os.Getenv("CS_SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	return defaultSecretsDir
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/csmanutd/csutils"
+)
+
+// mapSource is a credential source backed by a map of tenant/field to value
+// that counts its lookups
+type mapSource struct {
+	values  map[string]string
+	lookups int
+}
+
+func (s *mapSource) Name() string {
+	return "map"
+}
+
+func (s *mapSource) Lookup(tenant, field string) (string, error) {
+	s.lookups++
+	return s.values[tenant+"/"+field], nil
+}
+
+func (s *mapSource) Tenants() ([]string, error) {
+	return nil, nil
+}
+
+func TestLookupCredentials(t *testing.T) {
+	first := &mapSource{values: map[string]string{"t1/api_key": "key1", "t1/api_secret": "secret1", "t1/tenant_id": "id1", "t2/api_key": "key2"}}
+	second := &mapSource{values: map[string]string{"t1/api_key": "other", "t2/api_key": "other", "t2/api_secret": "secret2"}}
+	sources := []credentialSource{first, second}
+
+	info, found, err := lookupCredentials("t1", csutils.CloudSecureInfo{}, sources)
+	if err != nil || !found || info != (csutils.CloudSecureInfo{APIKey: "key1", APISecret: "secret1", TenantID: "id1"}) {
+		t.Errorf("t1 = %+v, %v, %v", info, found, err)
+	}
+	// the first source had every field, so the second is not asked
+	if second.lookups != 0 {
+		t.Errorf("second source asked %d times for a tenant the first one completed", second.lookups)
+	}
+
+	info, found, err = lookupCredentials("t2", csutils.CloudSecureInfo{TenantID: "id2"}, sources)
+	if err != nil || !found || info != (csutils.CloudSecureInfo{APIKey: "key2", APISecret: "secret2", TenantID: "id2"}) {
+		t.Errorf("t2 = %+v, %v, %v", info, found, err)
+	}
+	// only the fields missing after the first source are looked up
+	if second.lookups != 2 {
+		t.Errorf("second source asked %d times for t2, want 2", second.lookups)
+	}
+
+	if _, found, _ := lookupCredentials("t3", csutils.CloudSecureInfo{}, sources); found {
+		t.Error("found credentials of a tenant no source has")
+	}
+}
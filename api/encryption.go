@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/csmanutd/csutils"
+)
+
+// encryptedPrefix marks a secret field of csconfig.json encrypted with the
+// data key
+const encryptedPrefix = "enc:v1:"
+
+// Ways the data key of an encrypted csconfig.json is protected
+const (
+	kdfPassphrase = "pbkdf2-sha256"
+	kdfKeyFile    = "key-file"
+)
+
+// pbkdf2Iterations is the PBKDF2 work factor of new passphrases
+const pbkdf2Iterations = 600000
+
+// EncryptionSettings describe how the secret fields of csconfig.json are
+// encrypted. The api_key and api_secret of every tenant are encrypted with
+// AES-256-GCM under a random data key, which is itself encrypted with a key
+// derived from a passphrase or read from a key file.
+type EncryptionSettings struct {
+	KDF        string `json:"kdf"`
+	Salt       string `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	DataKey    string `json:"data_key"`
+}
+
+// configKey supplies the key protecting the data key: the key file, else the
+// passphrase, else a passphrase prompt when interactive
+type configKey struct {
+	KeyFile     string
+	Passphrase  string
+	Interactive bool
+}
+
+// configKeyFromEnv returns the key given by CS_CONFIG_KEY_FILE or
+// CS_CONFIG_PASSPHRASE, with keyFile taking precedence when set
+func configKeyFromEnv(keyFile string, interactive bool) configKey {
+	if keyFile == "" {
+		keyFile = os.Getenv("CS_CONFIG_KEY_FILE")
+	}
+	return configKey{KeyFile: keyFile, Passphrase: os.Getenv("CS_CONFIG_PASSPHRASE"), Interactive: interactive}
+}
+
+// newEncryption returns encryption settings for a new random data key
+// protected by key, and the data key
+func newEncryption(key configKey) (*EncryptionSettings, []byte, error) {
+	enc := &EncryptionSettings{KDF: kdfKeyFile}
+	if key.KeyFile == "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		enc.KDF = kdfPassphrase
+		enc.Salt = base64.StdEncoding.EncodeToString(salt)
+		enc.Iterations = pbkdf2Iterations
+	}
+	kek, err := key.derive(enc, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(kek, dataKey, []byte("data key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	enc.DataKey = wrapped
+	return enc, dataKey, nil
+}
+
+// unwrapDataKey returns the data key of enc, decrypted with key
+func unwrapDataKey(enc *EncryptionSettings, key configKey) ([]byte, error) {
+	kek, err := key.derive(enc, false)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(kek, enc.DataKey, []byte("data key"))
+	if err != nil {
+		if enc.KDF == kdfKeyFile {
+			return nil, fmt.Errorf("wrong key file")
+		}
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	return dataKey, nil
+}
+
+// derive returns the key encryption key for enc. confirm asks for a new
+// passphrase twice.
+func (k configKey) derive(enc *EncryptionSettings, confirm bool) ([]byte, error) {
+	switch enc.KDF {
+	case kdfKeyFile:
+		if k.KeyFile == "" {
+			return nil, fmt.Errorf("csconfig.json is encrypted with a key file, set CS_CONFIG_KEY_FILE or use -config-key-file")
+		}
+		return readKeyFile(k.KeyFile)
+	case kdfPassphrase:
+		passphrase := k.Passphrase
+		if passphrase == "" {
+			if !k.Interactive {
+				return nil, fmt.Errorf("csconfig.json is encrypted with a passphrase, set CS_CONFIG_PASSPHRASE")
+			}
+			var err error
+			if passphrase, err = promptPassphrase(confirm); err != nil {
+				return nil, err
+			}
+		}
+		salt, err := base64.StdEncoding.DecodeString(enc.Salt)
+		if err != nil || enc.Iterations <= 0 {
+			return nil, fmt.Errorf("invalid encryption settings")
+		}
+		return pbkdf2SHA256([]byte(passphrase), salt, enc.Iterations, 32), nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %q", enc.KDF)
+}
+
+// readKeyFile reads a 32 byte key, stored raw, in hex or in base64
+func readKeyFile(fileName string) ([]byte, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %v", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key file %s must hold 32 bytes, raw, hex or base64 (e.g. openssl rand -hex 32)", fileName)
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it;
+// a new passphrase is asked for twice
+func promptPassphrase(confirm bool) (string, error) {
+	prompt := "Enter the csconfig.json passphrase: "
+	if confirm {
+		prompt = "Enter a new csconfig.json passphrase: "
+	}
+	passphrase := readHidden(prompt)
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase")
+	}
+	if confirm && readHidden("Repeat the passphrase: ") != passphrase {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// readHidden prints prompt and reads a line with echo turned off by stty,
+// when stdin is a terminal
+func readHidden(prompt string) string {
+	fmt.Print(prompt)
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Println()
+		}()
+	}
+	// read a byte at a time, so that nothing after the line is buffered away
+	// from a later prompt
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimRight(string(line), "\r")
+}
+
+// encryptSecrets returns a copy of config with the api_key and api_secret of
+// every tenant encrypted with dataKey
+func encryptSecrets(config csutils.CloudSecureConfig, dataKey []byte) (csutils.CloudSecureConfig, error) {
+	encrypted := csutils.CloudSecureConfig{
+		CloudSecures:     make(map[string]csutils.CloudSecureInfo, len(config.CloudSecures)),
+		DefaultCloudName: config.DefaultCloudName,
+	}
+	for name, info := range config.CloudSecures {
+		for field, value := range map[string]*string{"api_key": &info.APIKey, "api_secret": &info.APISecret} {
+			if *value == "" || strings.HasPrefix(*value, encryptedPrefix) {
+				continue
+			}
+			sealed, err := seal(dataKey, []byte(*value), []byte(name+"/"+field))
+			if err != nil {
+				return encrypted, err
+			}
+			*value = encryptedPrefix + sealed
+		}
+		encrypted.CloudSecures[name] = info
+	}
+	return encrypted, nil
+}
+
+// decryptSecrets decrypts the encrypted fields of config in place. Fields
+// stored in clear text, such as those added by hand, are kept.
+func decryptSecrets(config *csutils.CloudSecureConfig, dataKey []byte) error {
+	for name, info := range config.CloudSecures {
+		for field, value := range map[string]*string{"api_key": &info.APIKey, "api_secret": &info.APISecret} {
+			if !strings.HasPrefix(*value, encryptedPrefix) {
+				continue
+			}
+			plain, err := open(dataKey, strings.TrimPrefix(*value, encryptedPrefix), []byte(name+"/"+field))
+			if err != nil {
+				return fmt.Errorf("error decrypting %s of %s: %v", field, name, err)
+			}
+			*value = string(plain)
+		}
+		config.CloudSecures[name] = info
+	}
+	return nil
+}
+
+// seal encrypts plaintext with AES-GCM, returning the nonce and ciphertext in
+// base64. additional binds the ciphertext to where it is stored.
+func seal(key, plaintext, additional []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additional)), nil
+}
+
+// open decrypts a value written by seal
+func open(key []byte, sealed string, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from password as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csmanutd/csutils"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// the first two are the PBKDF2-HMAC-SHA256 vectors of RFC 7914
+	tests := []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		want           string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, tt.keyLen))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, tt.keyLen, got, tt.want)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	sealed, err := seal(key, []byte("secret"), []byte("t1/api_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := open(key, sealed, []byte("t1/api_key"))
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("open = %q, %v, want secret", plain, err)
+	}
+
+	if _, err := open(bytes.Repeat([]byte{2}, 32), sealed, []byte("t1/api_key")); err == nil {
+		t.Error("open with the wrong key succeeded")
+	}
+	// a value moved to another tenant or field must not decrypt
+	if _, err := open(key, sealed, []byte("t2/api_key")); err == nil {
+		t.Error("open with other additional data succeeded")
+	}
+	if _, err := open(key, "AAAA", nil); err == nil {
+		t.Error("open of a short ciphertext succeeded")
+	}
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{3}, 32)
+	config := csutils.CloudSecureConfig{
+		CloudSecures: map[string]csutils.CloudSecureInfo{
+			"t1": {APIKey: "key1", APISecret: "secret1", TenantID: "id1"},
+			"t2": {APIKey: "key2", TenantID: "id2"},
+		},
+		DefaultCloudName: "t1",
+	}
+	encrypted, err := encryptSecrets(config, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CloudSecures["t1"].APIKey != "key1" {
+		t.Error("encryptSecrets changed its argument")
+	}
+	t1 := encrypted.CloudSecures["t1"]
+	if !strings.HasPrefix(t1.APIKey, encryptedPrefix) || !strings.HasPrefix(t1.APISecret, encryptedPrefix) {
+		t.Errorf("secrets of t1 not encrypted: %+v", t1)
+	}
+	if t1.TenantID != "id1" || encrypted.CloudSecures["t2"].APISecret != "" {
+		t.Errorf("unexpected fields after encryption: %+v", encrypted.CloudSecures)
+	}
+
+	// values already encrypted are kept as they are
+	again, err := encryptSecrets(encrypted, dataKey)
+	if err != nil || again.CloudSecures["t1"] != t1 {
+		t.Errorf("encrypting twice changed t1: %+v, %v", again.CloudSecures["t1"], err)
+	}
+
+	if err := decryptSecrets(&encrypted, dataKey); err != nil {
+		t.Fatal(err)
+	}
+	for name, info := range config.CloudSecures {
+		if encrypted.CloudSecures[name] != info {
+			t.Errorf("%s = %+v after decryption, want %+v", name, encrypted.CloudSecures[name], info)
+		}
+	}
+
+	swapped, _ := encryptSecrets(config, dataKey)
+	info := swapped.CloudSecures["t2"]
+	info.APIKey = swapped.CloudSecures["t1"].APIKey
+	swapped.CloudSecures["t2"] = info
+	if err := decryptSecrets(&swapped, dataKey); err == nil {
+		t.Error("decrypting a key copied from another tenant succeeded")
+	}
+}
+
+func TestDataKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	otherKeyFile := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(otherKeyFile, bytes.Repeat([]byte{7}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      configKey
+		wrongKey configKey
+	}{
+		{"passphrase", configKey{Passphrase: "correct horse"}, configKey{Passphrase: "wrong horse"}},
+		{"key file", configKey{KeyFile: keyFile}, configKey{KeyFile: otherKeyFile}},
+	}
+	for _, tt := range tests {
+		enc, dataKey, err := newEncryption(tt.key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := unwrapDataKey(enc, tt.key)
+		if err != nil || !bytes.Equal(got, dataKey) {
+			t.Errorf("%s: unwrapDataKey = %x, %v, want %x", tt.name, got, err, dataKey)
+		}
+		if _, err := unwrapDataKey(enc, tt.wrongKey); err == nil {
+			t.Errorf("%s: unwrapDataKey with the wrong key succeeded", tt.name)
+		}
+		if _, err := unwrapDataKey(enc, configKey{}); err == nil {
+			t.Errorf("%s: unwrapDataKey without a key succeeded", tt.name)
+		}
+	}
+}
+
+func TestSaveLoadEncryptedConfig(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "csconfig.json")
+	key := configKey{Passphrase: "correct horse"}
+	enc, dataKey, err := newEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		CloudSecureConfig: csutils.CloudSecureConfig{
+			CloudSecures:     map[string]csutils.CloudSecureInfo{"t1": {APIKey: "key1", APISecret: "secret1", TenantID: "id1"}},
+			DefaultCloudName: "t1",
+		},
+		Settings: Settings{Schedule: "0 2 * * *", Encryption: enc},
+		dataKey:  dataKey,
+	}
+	if err := SaveConfig(fileName, config); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("csconfig.json has mode %v, want 0600", perm)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret1")) || bytes.Contains(data, []byte("key1")) {
+		t.Errorf("csconfig.json holds the secrets in clear text:\n%s", data)
+	}
+
+	loaded, err := LoadConfig(fileName, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CloudSecures["t1"] != config.CloudSecures["t1"] || loaded.DefaultCloudName != "t1" || loaded.Schedule != "0 2 * * *" {
+		t.Errorf("LoadConfig = %+v, want %+v", loaded, config)
+	}
+	if _, err := LoadConfig(fileName, configKey{Passphrase: "wrong horse"}); err == nil {
+		t.Error("LoadConfig with the wrong passphrase succeeded")
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"), key); !os.IsNotExist(err) {
+		t.Errorf("LoadConfig of a missing file = %v, want a not exist error", err)
+	}
+}
@@ -0,0 +1,325 @@
+// Package fakecloudsecure serves a stand-in for the CloudSecure flows API, so
+// the fetcher can be exercised without credentials or network access.
+package fakecloudsecure
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlowsPath is the endpoint served, matching the real API
+const FlowsPath = "/api/v1/flows"
+
+// Config describes the tenants and the faults of a fake server
+type Config struct {
+	// Tenants are keyed by tenant ID, the x-tenant-id header. With no
+	// tenants every tenant ID is accepted and served synthetic flows.
+	Tenants map[string]Tenant `json:"tenants,omitempty"`
+
+	// FlowsPerHour is the synthetic flow rate of tenants that set none
+	FlowsPerHour int `json:"flows_per_hour,omitempty"`
+
+	// Overlapping also returns the flows that started before the period but
+	// were still active in it, so that adjacent periods share the flows
+	// active across their boundary
+	Overlapping bool `json:"overlapping,omitempty"`
+
+	Faults Faults `json:"faults,omitempty"`
+
+	// Seed makes the injected faults repeatable; 0 uses the current time
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// Tenant is one tenant of the fake server
+type Tenant struct {
+	// APIKey and APISecret are checked against the Basic auth header when set
+	APIKey    string `json:"api_key,omitempty"`
+	APISecret string `json:"api_secret,omitempty"`
+
+	// Fixture is a JSON file holding an array of flows, or an object with a
+	// "flows" array, in the API format. When set it replaces the synthetic
+	// flows; flows are returned when their start_time is in the period.
+	Fixture string `json:"fixture,omitempty"`
+
+	// FlowsPerHour overrides Config.FlowsPerHour for this tenant
+	FlowsPerHour int `json:"flows_per_hour,omitempty"`
+}
+
+// Faults are injected into a share of the requests. Rates are between 0 and 1.
+type Faults struct {
+	// ThrottleRate of requests are answered with 429 and a Retry-After header
+	ThrottleRate float64  `json:"throttle_rate,omitempty"`
+	RetryAfter   Duration `json:"retry_after,omitempty"`
+
+	// ErrorRate of requests are answered with 500
+	ErrorRate float64 `json:"error_rate,omitempty"`
+
+	// SlowRate of requests wait Delay before answering
+	SlowRate float64  `json:"slow_rate,omitempty"`
+	Delay    Duration `json:"delay,omitempty"`
+
+	// TruncateRate of responses are cut off half way through the flows
+	TruncateRate float64 `json:"truncate_rate,omitempty"`
+}
+
+// Duration is a time.Duration stored in JSON as a string such as "2s"
+type Duration time.Duration
+
+// UnmarshalJSON reads a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads a Config from a JSON file
+func LoadConfig(fileName string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("error reading %s: %v", fileName, err)
+	}
+	return config, nil
+}
+
+// Server is an http.Handler serving the flows endpoint
+type Server struct {
+	config   Config
+	fixtures map[string][]fixtureFlow
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// fixtureFlow is a flow read from a fixture file
+type fixtureFlow struct {
+	start time.Time
+	end   time.Time
+	raw   json.RawMessage
+}
+
+// NewServer returns a server for config, loading its fixture files
+func NewServer(config Config) (*Server, error) {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &Server{
+		config:   config,
+		fixtures: make(map[string][]fixtureFlow),
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+	for id, tenant := range config.Tenants {
+		if tenant.Fixture == "" {
+			continue
+		}
+		flows, err := loadFixture(tenant.Fixture)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", id, err)
+		}
+		s.fixtures[id] = flows
+	}
+	return s, nil
+}
+
+// flowsRequest is the body of a flows request
+type flowsRequest struct {
+	Period struct {
+		StartTime time.Time `json:"start_time"`
+		EndTime   time.Time `json:"end_time"`
+	} `json:"period"`
+	MaxResults int `json:"max_results"`
+}
+
+// ServeHTTP answers a flows request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != FlowsPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID := r.Header.Get("x-tenant-id")
+	tenant, known := s.config.Tenants[tenantID]
+	if len(s.config.Tenants) > 0 && !known {
+		fmt.Printf("fake-cloudsecure: unknown tenant %q\n", tenantID)
+		http.Error(w, "unknown tenant", http.StatusForbidden)
+		return
+	}
+	if tenant.APIKey != "" || tenant.APISecret != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(tenant.APIKey+":"+tenant.APISecret))
+		if r.Header.Get("Authorization") != want {
+			fmt.Printf("fake-cloudsecure: bad credentials for tenant %s\n", tenantID)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var req flowsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	from, to := req.Period.StartTime, req.Period.EndTime
+	if !from.Before(to) {
+		http.Error(w, "invalid period", http.StatusBadRequest)
+		return
+	}
+
+	faults := s.config.Faults
+	period := fmt.Sprintf("%s to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if s.chance(faults.SlowRate) {
+		fmt.Printf("fake-cloudsecure: %s %s: delaying %v\n", tenantID, period, time.Duration(faults.Delay))
+		select {
+		case <-time.After(time.Duration(faults.Delay)):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if s.chance(faults.ThrottleRate) {
+		fmt.Printf("fake-cloudsecure: %s %s: 429\n", tenantID, period)
+		if faults.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(time.Duration(faults.RetryAfter).Seconds())))
+		}
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	if s.chance(faults.ErrorRate) {
+		fmt.Printf("fake-cloudsecure: %s %s: 500\n", tenantID, period)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var flows []json.RawMessage
+	if fixture, ok := s.fixtures[tenantID]; ok {
+		for _, flow := range fixture {
+			if inPeriod(flow.start, flow.end, from, to, s.config.Overlapping) {
+				flows = append(flows, flow.raw)
+			}
+		}
+	} else {
+		rate := tenant.FlowsPerHour
+		if rate == 0 {
+			rate = s.config.FlowsPerHour
+		}
+		flows = syntheticFlows(tenantID, from, to, rate, req.MaxResults, s.config.Overlapping)
+	}
+	if req.MaxResults > 0 && len(flows) > req.MaxResults {
+		flows = flows[:req.MaxResults]
+	}
+
+	truncate := s.chance(faults.TruncateRate)
+	if truncate {
+		fmt.Printf("fake-cloudsecure: %s %s: truncating response of %d flows\n", tenantID, period, len(flows))
+	} else {
+		fmt.Printf("fake-cloudsecure: %s %s: %d flows\n", tenantID, period, len(flows))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"flows":[`)
+	for i, flow := range flows {
+		if truncate && i == len(flows)/2 {
+			// drop the connection mid-body, as a failing proxy would
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		w.Write(flow)
+	}
+	if truncate {
+		panic(http.ErrAbortHandler)
+	}
+	fmt.Fprintf(w, `],"total_count":%d}`, len(flows))
+}
+
+// chance reports true for a share rate of calls
+func (s *Server) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < rate
+}
+
+// inPeriod reports whether a flow active from start to end is returned for
+// [from, to): when it starts in the period or, with overlapping, when it is
+// still active at its start
+func inPeriod(start, end, from, to time.Time, overlapping bool) bool {
+	if !start.Before(to) {
+		return false
+	}
+	return !start.Before(from) || (overlapping && end.After(from))
+}
+
+// loadFixture reads the flows of a fixture file
+func loadFixture(fileName string) ([]fixtureFlow, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixture: %v", err)
+	}
+
+	var raws []json.RawMessage
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &raws)
+	} else {
+		var wrapped struct {
+			Flows []json.RawMessage `json:"flows"`
+		}
+		err = json.Unmarshal(data, &wrapped)
+		raws = wrapped.Flows
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixture %s: %v", fileName, err)
+	}
+
+	flows := make([]fixtureFlow, 0, len(raws))
+	for i, raw := range raws {
+		var fields struct {
+			StartTime string `json:"start_time"`
+			EndTime   string `json:"end_time"`
+		}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("fixture %s flow %d: %v", fileName, i, err)
+		}
+		start, err := time.Parse(time.RFC3339, fields.StartTime)
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s flow %d: invalid start_time: %v", fileName, i, err)
+		}
+		end, err := time.Parse(time.RFC3339, fields.EndTime)
+		if err != nil {
+			end = start
+		}
+		flows = append(flows, fixtureFlow{start: start, end: end, raw: raw})
+	}
+	return flows, nil
+}
@@ -0,0 +1,194 @@
+package fakecloudsecure_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+	"github.com/csmanutd/cs-traffic-filtering/api/fakecloudsecure"
+)
+
+var day = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// failFirst returns a Recorder.Fail failing the first n requests
+func failFirst(n int) func(time.Time) bool {
+	return func(time.Time) bool {
+		n--
+		return n >= 0
+	}
+}
+
+// newFake returns a fake server for config behind a Recorder, and a client
+// for its tenant
+func newFake(t *testing.T, config fakecloudsecure.Config) (*fakecloudsecure.Recorder, *cloudsecure.Client) {
+	t.Helper()
+	server, err := fakecloudsecure.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &fakecloudsecure.Recorder{Handler: server}
+	return rec, fakecloudsecure.NewTestClient(t, rec)
+}
+
+// collect returns the flows of the test tenant in [from, to), failing on error or on a
+// flow returned twice
+func collect(t *testing.T, client *cloudsecure.Client, from, to time.Time) []cloudsecure.Flow {
+	t.Helper()
+	var flows []cloudsecure.Flow
+	seen := make(map[string]bool)
+	for flow, err := range client.Flows(context.Background(), fakecloudsecure.TestTenant, from, to) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[string(flow.Raw)] {
+			t.Fatalf("flow returned twice: %s", flow.Raw)
+		}
+		seen[string(flow.Raw)] = true
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		status       int
+		failures     int
+		wantRequests int
+		wantErr      bool
+	}{
+		{http.StatusTooManyRequests, 2, 3, false},
+		{http.StatusInternalServerError, 2, 3, false},
+		{http.StatusBadGateway, 4, 5, false},
+		{http.StatusServiceUnavailable, 5, 5, true},
+		// permanent errors are not retried
+		{http.StatusUnauthorized, 1, 1, true},
+		{http.StatusBadRequest, 1, 1, true},
+	}
+	for _, tt := range tests {
+		rec, client := newFake(t, fakecloudsecure.Config{FlowsPerHour: 60})
+		rec.Status, rec.Fail = tt.status, failFirst(tt.failures)
+
+		flows, err := client.FetchFlows(context.Background(), fakecloudsecure.TestTenant, cloudsecure.FlowQuery{
+			From:       day,
+			To:         day.Add(time.Hour),
+			MaxResults: 1000,
+		})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%d x %d: no error", tt.failures, tt.status)
+			}
+		} else if err != nil || len(flows) != 60 {
+			t.Errorf("%d x %d: %d flows, %v; want 60 flows", tt.failures, tt.status, len(flows), err)
+		}
+		if got := rec.Count(); got != tt.wantRequests {
+			t.Errorf("%d x %d: %d requests, want %d", tt.failures, tt.status, got, tt.wantRequests)
+		}
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	from, to := day, day.Add(6*time.Hour)
+	_, clean := newFake(t, fakecloudsecure.Config{FlowsPerHour: 60})
+	want := collect(t, clean, from, to)
+	if len(want) != 360 {
+		t.Fatalf("%d flows without faults, want 360", len(want))
+	}
+
+	tests := []struct {
+		name   string
+		faults fakecloudsecure.Faults
+	}{
+		{"throttled", fakecloudsecure.Faults{ThrottleRate: 0.5}},
+		{"server errors", fakecloudsecure.Faults{ErrorRate: 0.5}},
+		{"truncated responses", fakecloudsecure.Faults{TruncateRate: 0.5}},
+	}
+	for _, tt := range tests {
+		rec, client := newFake(t, fakecloudsecure.Config{FlowsPerHour: 60, Seed: 1, Faults: tt.faults})
+		client.Retry.MaxAttempts = 50
+		// one hour segments, so that six requests are needed without faults
+		client.Segments.Initial, client.Segments.Max = time.Hour, time.Hour
+
+		got := collect(t, client, from, to)
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d flows, want %d", tt.name, len(got), len(want))
+		}
+		for i := range want {
+			if string(got[i].Raw) != string(want[i].Raw) {
+				t.Fatalf("%s: flow %d = %s, want %s", tt.name, i, got[i].Raw, want[i].Raw)
+			}
+		}
+		if rec.Count() <= 6 {
+			t.Errorf("%s: %d requests for 6 segments, no fault was injected", tt.name, rec.Count())
+		}
+	}
+}
+
+func TestSegmentSplitting(t *testing.T) {
+	rec, client := newFake(t, fakecloudsecure.Config{FlowsPerHour: 60})
+	client.Segments = cloudsecure.SegmentOptions{
+		MaxResults: 10,
+		Initial:    2 * time.Hour,
+		Min:        time.Minute,
+		Max:        24 * time.Hour,
+	}
+
+	flows := collect(t, client, day, day.Add(6*time.Hour))
+	if len(flows) != 360 {
+		t.Fatalf("%d flows, want 360", len(flows))
+	}
+	for i := 1; i < len(flows); i++ {
+		if flows[i].StartTime <= flows[i-1].StartTime {
+			t.Fatalf("flow %d starts at %s after %s", i, flows[i].StartTime, flows[i-1].StartTime)
+		}
+	}
+	// a response of MaxResults flows is split until every segment holds
+	// fewer, so far more than the three initial segments are requested
+	if rec.Count() < 360/10 {
+		t.Errorf("%d requests, segments were not split", rec.Count())
+	}
+}
+
+func TestSegmentSplittingStopsAtMin(t *testing.T) {
+	_, client := newFake(t, fakecloudsecure.Config{FlowsPerHour: 3600})
+	client.Segments = cloudsecure.SegmentOptions{
+		MaxResults: 10,
+		Initial:    time.Hour,
+		Min:        time.Minute,
+		Max:        time.Hour,
+	}
+
+	// a minute still holds 60 flows, so each minute returns its first 10
+	flows := collect(t, client, day, day.Add(2*time.Minute))
+	if len(flows) != 20 {
+		t.Errorf("%d flows, want 20", len(flows))
+	}
+}
+
+func TestFlowsFilter(t *testing.T) {
+	_, client := newFake(t, fakecloudsecure.Config{FlowsPerHour: 60})
+	all := collect(t, client, day, day.Add(6*time.Hour))
+
+	client.Filter = &cloudsecure.FlowFilter{Statuses: []string{"ALLOWED"}, Ports: []int{443}}
+	client.Segments.MaxResults = 10
+	filtered := collect(t, client, day, day.Add(6*time.Hour))
+
+	want := 0
+	for _, flow := range all {
+		if client.Filter.Match(flow) {
+			want++
+		}
+	}
+	if want == 0 || want == len(all) {
+		t.Fatalf("%d of %d flows match, the filter does not select", want, len(all))
+	}
+	if len(filtered) != want {
+		t.Errorf("%d flows with the filter, want %d", len(filtered), want)
+	}
+	for _, flow := range filtered {
+		if flow.Status != "ALLOWED" || flow.DstPort != 443 {
+			t.Errorf("flow %s does not pass the filter", flow.Raw)
+		}
+	}
+}
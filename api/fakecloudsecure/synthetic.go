@@ -0,0 +1,117 @@
+package fakecloudsecure
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// defaultFlowsPerHour is the synthetic flow rate when none is configured
+const defaultFlowsPerHour = 60
+
+// maxFlowDuration is the longest a synthetic flow stays active
+const maxFlowDuration = 300 * time.Second
+
+var (
+	roles        = []string{"web", "app", "db", "cache", "batch"}
+	environments = []string{"prod", "staging", "dev", "test"}
+	statuses     = []string{"ALLOWED", "ALLOWED", "ALLOWED", "POTENTIALLY_BLOCKED", "BLOCKED"}
+	services     = []struct {
+		port     int
+		protocol string
+	}{{443, "TCP"}, {443, "TCP"}, {80, "TCP"}, {22, "TCP"}, {53, "UDP"}, {3306, "TCP"}, {5432, "TCP"}, {8080, "TCP"}}
+)
+
+// syntheticFlows returns the flows of tenant starting in [from, to), at most
+// limit of them when limit is positive. Flows are spaced evenly at rate per
+// hour on a fixed grid and every field is derived from the tenant and start
+// time, so any window always returns the same flows. Adjacent windows never
+// overlap unless overlapping adds the flows still active at from.
+func syntheticFlows(tenant string, from, to time.Time, rate, limit int, overlapping bool) []json.RawMessage {
+	if rate <= 0 {
+		rate = defaultFlowsPerHour
+	}
+	interval := time.Hour / time.Duration(rate)
+	if interval <= 0 {
+		interval = time.Nanosecond
+	}
+
+	first := from
+	if overlapping {
+		first = from.Add(-maxFlowDuration)
+	}
+	start := first.Truncate(interval)
+	if start.Before(first) {
+		start = start.Add(interval)
+	}
+
+	var flows []json.RawMessage
+	for ts := start; ts.Before(to); ts = ts.Add(interval) {
+		if limit > 0 && len(flows) >= limit {
+			break
+		}
+		flow, end := syntheticFlow(tenant, ts)
+		if inPeriod(ts, end, from, to, overlapping) {
+			flows = append(flows, flow)
+		}
+	}
+	return flows
+}
+
+// syntheticFlow returns the flow of tenant starting at ts and its end time
+func syntheticFlow(tenant string, ts time.Time) (json.RawMessage, time.Time) {
+	h := fnv.New64a()
+	h.Write([]byte(tenant))
+	binary.Write(h, binary.BigEndian, ts.UnixNano())
+	pick := rand.New(rand.NewSource(int64(h.Sum64()))).Intn
+
+	// internal endpoints are workloads in one of four VPCs of the tenant
+	workload := func(vpc int) map[string]interface{} {
+		role := roles[pick(len(roles))]
+		env := environments[vpc%len(environments)]
+		return map[string]interface{}{
+			"ip_address": fmt.Sprintf("10.%d.%d.%d", vpc, pick(256), 1+pick(254)),
+			"workload":   map[string]string{"name": fmt.Sprintf("%s-%s-%02d", role, env, 1+pick(20))},
+			"labels": []map[string]string{
+				{"key": "app", "value": role},
+				{"key": "env", "value": env},
+			},
+			"vpc_id":     fmt.Sprintf("vpc-%08x", fnvString(tenant)+uint32(vpc)),
+			"account_id": fmt.Sprintf("%012d", fnvString(tenant)),
+		}
+	}
+
+	service := services[pick(len(services))]
+	src := workload(pick(4))
+	var dst interface{}
+	if pick(4) == 0 {
+		dst = map[string]string{"ip_address": fmt.Sprintf("52.%d.%d.%d", pick(256), pick(256), 1+pick(254))}
+	} else {
+		dst = workload(pick(4))
+	}
+
+	status := statuses[pick(len(statuses))]
+	end := ts.Add(time.Duration(1+pick(int(maxFlowDuration/time.Second))) * time.Second)
+	flow := map[string]interface{}{
+		"status":     status,
+		"start_time": ts.UTC().Format(time.RFC3339),
+		"end_time":   end.UTC().Format(time.RFC3339),
+		"src":        src,
+		"dst":        dst,
+		"dst_port":   service.port,
+		"protocol":   service.protocol,
+		"bytes":      64 + pick(1<<20),
+	}
+	data, _ := json.Marshal(flow)
+	return data, end
+}
+
+// fnvString returns the 32-bit FNV-1a hash of s
+func fnvString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,97 @@
+package fakecloudsecure
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// TestTenant is the tenant of the clients returned by NewTestClient
+const TestTenant = "t1"
+
+// NewTestClient serves handler, usually a Server or a Recorder around one,
+// for the duration of the test and returns a client for its tenant
+// TestTenant. The client retries after a few milliseconds rather than
+// seconds; tests change its Retry and Segments as they need.
+func NewTestClient(t testing.TB, handler http.Handler) *cloudsecure.Client {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	client := cloudsecure.NewClient(map[string]cloudsecure.Credentials{
+		TestTenant: {APIKey: "key", APISecret: "secret", TenantID: TestTenant},
+	})
+	client.BaseURL = ts.URL
+	client.Retry = cloudsecure.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Multiplier:     2,
+	}
+	return client
+}
+
+// Recorder passes requests on to Handler and records the period start of
+// each. Requests for which Fail returns true are answered with Status
+// instead, 503 when Status is zero. Fail is called with the Recorder locked.
+type Recorder struct {
+	Handler http.Handler
+	Fail    func(start time.Time) bool
+	Status  int
+
+	mu     sync.Mutex
+	starts []time.Time
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var flows flowsRequest
+	json.Unmarshal(body, &flows)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	r.mu.Lock()
+	r.starts = append(r.starts, flows.Period.StartTime)
+	fail := r.Fail != nil && r.Fail(flows.Period.StartTime)
+	status := r.Status
+	r.mu.Unlock()
+	if fail {
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	r.Handler.ServeHTTP(w, req)
+}
+
+// Starts returns the period starts of the requests since the last Reset
+func (r *Recorder) Starts() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.starts...)
+}
+
+// Count returns the number of requests since the last Reset
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.starts)
+}
+
+// Reset forgets the requests recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starts = nil
+}
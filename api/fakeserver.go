@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/fakecloudsecure"
+)
+
+// runFakeServer implements the fake-cloudsecure subcommand
+func runFakeServer(args []string) error {
+	fs := flag.NewFlagSet("fake-cloudsecure", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "Address to listen on")
+	configFile := fs.String("config", "", "JSON file with tenants, fixtures and faults")
+	tenants := fs.String("tenants", "", "Comma separated tenant IDs to accept, empty for any")
+	fixture := fs.String("fixture", "", "JSON file of flows served to every tenant in -tenants instead of synthetic flows")
+	flowsPerHour := fs.Int("flows-per-hour", 0, "Synthetic flows per hour and tenant (default 60)")
+	overlapping := fs.Bool("overlapping", false, "Also return flows that started before the requested period but were still active in it")
+	throttleRate := fs.Float64("throttle-rate", 0, "Share of requests answered with 429")
+	retryAfter := fs.Duration("retry-after", 0, "Retry-After sent with 429 responses")
+	errorRate := fs.Float64("error-rate", 0, "Share of requests answered with 500")
+	slowRate := fs.Float64("slow-rate", 0, "Share of requests delayed by -delay")
+	delay := fs.Duration("delay", 5*time.Second, "Delay of slow requests")
+	truncateRate := fs.Float64("truncate-rate", 0, "Share of responses cut off half way")
+	seed := fs.Int64("seed", 0, "Seed for fault injection, 0 for random")
+	fs.Parse(args)
+
+	var config fakecloudsecure.Config
+	if *configFile != "" {
+		var err error
+		config, err = fakecloudsecure.LoadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// flags given on the command line override the config file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "flows-per-hour":
+			config.FlowsPerHour = *flowsPerHour
+		case "overlapping":
+			config.Overlapping = *overlapping
+		case "throttle-rate":
+			config.Faults.ThrottleRate = *throttleRate
+		case "retry-after":
+			config.Faults.RetryAfter = fakecloudsecure.Duration(*retryAfter)
+		case "error-rate":
+			config.Faults.ErrorRate = *errorRate
+		case "slow-rate":
+			config.Faults.SlowRate = *slowRate
+		case "delay":
+			config.Faults.Delay = fakecloudsecure.Duration(*delay)
+		case "truncate-rate":
+			config.Faults.TruncateRate = *truncateRate
+		case "seed":
+			config.Seed = *seed
+		}
+	})
+	if config.Faults.SlowRate > 0 && config.Faults.Delay == 0 {
+		config.Faults.Delay = fakecloudsecure.Duration(*delay)
+	}
+	if *fixture != "" && *tenants == "" {
+		return fmt.Errorf("-fixture needs -tenants")
+	}
+	for _, id := range strings.Split(*tenants, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if config.Tenants == nil {
+			config.Tenants = make(map[string]fakecloudsecure.Tenant)
+		}
+		tenant := config.Tenants[id]
+		if *fixture != "" {
+			tenant.Fixture = *fixture
+		}
+		config.Tenants[id] = tenant
+	}
+
+	handler, err := fakecloudsecure.NewServer(config)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: *listen, Handler: handler}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Fake CloudSecure listening on http://%s%s\n", *listen, fakecloudsecure.FlowsPath)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// tenantColumn is added to the output when several tenants share one file
+const tenantColumn = "Tenant"
+
+// fetchOptions control how a day is fetched
+type fetchOptions struct {
+	// Resume continues a previous run from its manifest
+	Resume bool
+	// Concurrency is the number of segments of one tenant fetched at the same time
+	Concurrency int
+	// Slots bounds the number of segments in flight across every fetch that
+	// shares it. Nil means no bound beyond Concurrency.
+	Slots chan struct{}
+	// Filter keeps only the matching flows of every segment
+	Filter *cloudsecure.FlowFilter
+	// Format is the output format, one of cloudsecure.Formats
+	Format string
+	// Mapper builds the output rows, nil for cloudsecure.DefaultMapper
+	Mapper cloudsecure.FlowMapper
+	// AllFields writes every field of the flows, flattened, instead of Mapper
+	AllFields bool
+	// Enrich adds the workload, labels, VPC and account of both endpoints
+	Enrich bool
+	// Dedup writes flows returned by several segments only once
+	Dedup bool
+	// DedupKey are the fields identifying a flow for Dedup, nil for
+	// cloudsecure.DefaultDedupKey
+	DedupKey []string
+	// Aggregate writes one row per group of AggregateKey and time Bucket
+	// instead of every flow
+	Aggregate bool
+	// AggregateKey are the group-by fields, nil for
+	// cloudsecure.DefaultAggregateKey
+	AggregateKey []string
+	// Bucket is the time bucket of Aggregate, one of cloudsecure.AggregateBuckets
+	Bucket string
+	// Compress is the compression of the output, one of
+	// cloudsecure.Compressions or empty for none
+	Compress string
+}
+
+// fetchDay retrieves all flows of one day for tenants and writes them to
+// outputFile. Each segment is buffered to its own file and recorded in a
+// manifest next to the output, so that a failed run can be continued with
+// opts.Resume; the output is assembled from the segment files at the end.
+// With several tenants their flows are combined in one file with a Tenant
+// column, and each tenant keeps its own manifest. It returns the number of
+// duplicate flows dropped with opts.Dedup.
+func fetchDay(ctx context.Context, client *cloudsecure.Client, tenants []string, date time.Time, outputFile string, opts fetchOptions) (int, error) {
+	combined := len(tenants) > 1
+	from, to := date, date.AddDate(0, 0, 1)
+
+	manifests := make([]*segmentManifest, len(tenants))
+	complete := true
+	for i, tenant := range tenants {
+		base := outputFile
+		if combined {
+			base = outputFile + "." + tenant
+		}
+		manifest, err := openManifest(base, tenant, from, to, opts.Filter, opts.Resume)
+		if err != nil {
+			return 0, err
+		}
+		manifests[i] = manifest
+		complete = complete && manifest.Complete
+	}
+	if complete {
+		fmt.Printf("%s is already complete, nothing to resume\n", outputFile)
+		return 0, nil
+	}
+
+	// a tenant completed by an earlier combined run no longer has its segment
+	// files, so it has to be fetched again for the combined file
+	for i, manifest := range manifests {
+		if manifest.Complete {
+			fresh, err := openManifest(manifest.base, manifest.Tenant, from, to, manifest.Filter, false)
+			if err != nil {
+				return 0, err
+			}
+			manifests[i] = fresh
+		}
+	}
+
+	errs := make([]error, len(manifests))
+	var wg sync.WaitGroup
+	for i, manifest := range manifests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fetchSegments(ctx, client, manifest, opts)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return 0, err
+	}
+
+	// segments finish in any order, the output is written from their files
+	// in chronological order once all of them are in
+	duplicates, err := assembleOutput(outputFile, manifests, combined, opts)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Dedup {
+		fmt.Printf("Removed %d duplicate flows from %s\n", duplicates, outputFile)
+	}
+	for _, manifest := range manifests {
+		if err := manifest.finish(); err != nil {
+			return 0, err
+		}
+	}
+	return duplicates, nil
+}
+
+// fetchSegments fetches the segments missing from manifest
+func fetchSegments(ctx context.Context, client *cloudsecure.Client, manifest *segmentManifest, opts fetchOptions) error {
+	tenant := manifest.Tenant
+	planner := cloudsecure.NewSegmentPlannerFor(manifest.missing(), client.Segments)
+
+	// add concurrent processing
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				seg, ok := planner.Next()
+				if !ok {
+					return
+				}
+
+				if opts.Slots != nil {
+					select {
+					case opts.Slots <- struct{}{}:
+					case <-ctx.Done():
+						planner.Done(seg, 0, ctx.Err())
+						return
+					}
+				}
+
+				startTime := time.Now()
+				fmt.Printf("Started processing %s segment %s\n", tenant, seg)
+
+				spoolFile, count, rows, err := fetchSegment(ctx, client, tenant, manifest.base, seg, manifest.Filter)
+				if opts.Slots != nil {
+					<-opts.Slots
+				}
+				if err == nil && !planner.ShouldSplit(seg, count) {
+					truncated := planner.IsTruncated(count)
+					if truncated {
+						fmt.Printf("Error: %s segment %s still returned %d flows at the minimum segment size, some flows are missing\n", tenant, seg, count)
+					}
+					err = manifest.addPart(seg, spoolFile, rows, truncated)
+				} else if spoolFile != "" {
+					os.Remove(spoolFile)
+				}
+
+				if err != nil {
+					fmt.Printf("Error processing %s segment %s: %v\n", tenant, seg, err)
+				} else {
+					fmt.Printf("%s segment %s processed in %v (%d flows)\n", tenant, seg, time.Since(startTime), rows)
+				}
+				planner.Done(seg, count, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := planner.Err(); err != nil {
+		if ctx.Err() != nil {
+			abandoned := manifest.missing()
+			if saveErr := manifest.abandon(abandoned); saveErr != nil {
+				fmt.Printf("Error recording abandoned segments: %v\n", saveErr)
+			}
+			for _, seg := range abandoned {
+				fmt.Printf("Abandoned %s segment %s\n", tenant, seg)
+			}
+			err = fmt.Errorf("interrupted: %v", ctx.Err())
+		}
+		fmt.Printf("Completed segments are recorded in %s, run again with --resume to fetch only the missing ones\n", manifest.path)
+		return fmt.Errorf("%s: %v", tenant, err)
+	}
+	if truncated := manifest.truncated(); len(truncated) > 0 {
+		fmt.Printf("Truncated segments are recorded in %s, lower -min-segment or raise -max-results and run again with --resume to fetch them again\n", manifest.path)
+		return fmt.Errorf("%s: %d segments still truncated at the minimum segment size of %v", tenant, len(truncated), client.Segments.Min)
+	}
+	return nil
+}
+
+// fetchSegment streams the flows of one segment of tenant into a temporary
+// file next to base, one JSON object per line, retrying failed attempts from
+// scratch. It returns the temporary file, the number of flows received, which
+// tells whether the response was truncated, and the number of flows written
+// to the file, which is smaller when filter drops some.
+func fetchSegment(ctx context.Context, client *cloudsecure.Client, tenant, base string, seg cloudsecure.Segment, filter *cloudsecure.FlowFilter) (string, int, int, error) {
+	spool, err := os.CreateTemp(filepath.Dir(base), "."+filepath.Base(base)+".segment-*")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("error creating segment file: %v", err)
+	}
+	spoolFile := spool.Name()
+	defer spool.Close()
+
+	rows := 0
+	count, err := cloudsecure.WithRetry(ctx, client.Retry, func() (int, error) {
+		rows = 0
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := spool.Truncate(0); err != nil {
+			return 0, err
+		}
+
+		writer := bufio.NewWriter(spool)
+		var line bytes.Buffer
+		count, err := client.StreamFlows(ctx, tenant, cloudsecure.FlowQuery{
+			From:       seg.From,
+			To:         seg.To,
+			MaxResults: client.Segments.MaxResults,
+			FileName:   filepath.Base(base),
+			Filter:     filter,
+		}, func(flow cloudsecure.Flow) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			line.Reset()
+			if err := json.Compact(&line, flow.Raw); err != nil {
+				return err
+			}
+			line.WriteByte('\n')
+			rows++
+			_, err := writer.Write(line.Bytes())
+			return err
+		})
+		if err != nil {
+			return count, err
+		}
+		return count, writer.Flush()
+	})
+
+	return spoolFile, count, rows, err
+}
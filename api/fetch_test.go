@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+	"github.com/csmanutd/cs-traffic-filtering/api/fakecloudsecure"
+)
+
+// testTenants are the tenants fetched from the fake server
+var testTenants = []string{fakecloudsecure.TestTenant}
+
+// newTestClient returns a client of the fake server behind handler that does
+// not retry and fetches two hours at a time
+func newTestClient(t *testing.T, handler http.Handler) *cloudsecure.Client {
+	t.Helper()
+	client := fakecloudsecure.NewTestClient(t, handler)
+	client.Retry.MaxAttempts = 1
+	client.Segments.Initial, client.Segments.Max = 2*time.Hour, 2*time.Hour
+	return client
+}
+
+// outage returns a Recorder around server that, while down is set, fails
+// the requests for periods starting at or after from
+func outage(server http.Handler, from time.Time, down *atomic.Bool) *fakecloudsecure.Recorder {
+	return &fakecloudsecure.Recorder{
+		Handler: server,
+		Fail: func(start time.Time) bool {
+			return down.Load() && !start.Before(from)
+		},
+	}
+}
+
+// requested returns the period starts requested since the last call
+func requested(rec *fakecloudsecure.Recorder) []time.Time {
+	starts := rec.Starts()
+	rec.Reset()
+	return starts
+}
+
+func TestFetchDayResume(t *testing.T) {
+	server, err := fakecloudsecure.NewServer(fakecloudsecure.Config{FlowsPerHour: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	noon := date.Add(12 * time.Hour)
+	var down atomic.Bool
+	down.Store(true)
+	fake := outage(server, noon, &down)
+	client := newTestClient(t, fake)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// one segment at a time, so the run stops at the first failure at noon
+	opts := fetchOptions{Concurrency: 1, Format: "csv"}
+	outputFile := filepath.Join(dir, "20260101.csv")
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err == nil {
+		t.Fatal("fetchDay succeeded during the outage")
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("output written by a failed run: %v", err)
+	}
+	manifest, err := loadManifest(outputFile + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Segments) != 6 || manifest.Complete {
+		t.Fatalf("manifest has %d segments, complete %v; want the 6 before noon", len(manifest.Segments), manifest.Complete)
+	}
+	requested(fake)
+
+	down.Store(false)
+	opts.Resume = true
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err != nil {
+		t.Fatal(err)
+	}
+	starts := requested(fake)
+	for _, start := range starts {
+		if start.Before(noon) {
+			t.Errorf("resume fetched the completed segment starting at %v again", start)
+		}
+	}
+	if len(starts) != 6 {
+		t.Errorf("resume sent %d requests, want 6 for the segments after noon", len(starts))
+	}
+	manifest, err = loadManifest(outputFile + ".manifest.json")
+	if err != nil || !manifest.Complete {
+		t.Fatalf("manifest not complete after resume: %v", err)
+	}
+
+	// the resumed output is the same as that of a run without failures
+	cleanFile := filepath.Join(dir, "clean.csv")
+	if _, err := fetchDay(ctx, newTestClient(t, server), testTenants, date, cleanFile, fetchOptions{Concurrency: 2, Format: "csv"}); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := os.ReadFile(cleanFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(clean, []byte("\n")); lines != 24*60+1 {
+		t.Errorf("clean run wrote %d lines, want %d", lines, 24*60+1)
+	}
+	if !bytes.Equal(resumed, clean) {
+		t.Error("resumed output differs from a run without failures")
+	}
+
+	// a complete run is not fetched again
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err != nil {
+		t.Fatal(err)
+	}
+	if starts := requested(fake); len(starts) != 0 {
+		t.Errorf("resuming a complete run sent %d requests", len(starts))
+	}
+}
+
+func TestFetchDayResumeDiscardsCorruptSegments(t *testing.T) {
+	server, err := fakecloudsecure.NewServer(fakecloudsecure.Config{FlowsPerHour: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var down atomic.Bool
+	down.Store(true)
+	fake := outage(server, date.Add(12*time.Hour), &down)
+	client := newTestClient(t, fake)
+	outputFile := filepath.Join(t.TempDir(), "20260101.csv")
+	opts := fetchOptions{Concurrency: 1, Format: "csv"}
+	ctx := context.Background()
+
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err == nil {
+		t.Fatal("fetchDay succeeded during the outage")
+	}
+	manifest, err := loadManifest(outputFile + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a segment file changed since it was recorded is fetched again
+	corrupt := manifest.Segments[0]
+	if err := os.WriteFile(filepath.Join(outputFile+".parts", corrupt.File), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	requested(fake)
+
+	down.Store(false)
+	opts.Resume = true
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err != nil {
+		t.Fatal(err)
+	}
+	refetched := false
+	for _, start := range requested(fake) {
+		refetched = refetched || start.Equal(corrupt.From)
+	}
+	if !refetched {
+		t.Errorf("corrupt segment starting at %v was not fetched again", corrupt.From)
+	}
+}
+
+func TestFetchDayTruncatedSegments(t *testing.T) {
+	server, err := fakecloudsecure.NewServer(fakecloudsecure.Config{FlowsPerHour: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := newTestClient(t, server)
+	// an hour holds 60 flows, more than a request returns, and cannot be split
+	client.Segments.MaxResults, client.Segments.Min = 50, time.Hour
+	outputFile := filepath.Join(t.TempDir(), "20260101.csv")
+	opts := fetchOptions{Concurrency: 2, Format: "csv"}
+	ctx := context.Background()
+
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err == nil {
+		t.Fatal("fetchDay succeeded with truncated segments")
+	}
+	if _, err := os.Stat(outputFile); !os.IsNotExist(err) {
+		t.Errorf("output written with truncated segments: %v", err)
+	}
+	manifest, err := loadManifest(outputFile + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Complete || len(manifest.truncated()) != 24 {
+		t.Fatalf("manifest complete %v with %d truncated segments, want 24 and not complete", manifest.Complete, len(manifest.truncated()))
+	}
+
+	// resuming with room for every flow fetches the truncated segments again
+	client.Segments.MaxResults = 100
+	opts.Resume = true
+	if _, err := fetchDay(ctx, client, testTenants, date, outputFile, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 24*60+1 {
+		t.Errorf("resumed run wrote %d lines, want %d", lines, 24*60+1)
+	}
+}
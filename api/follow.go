@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// hourFormat names the hourly files written by -follow
+const hourFormat = "2006010215"
+
+// followOptions control -follow
+type followOptions struct {
+	// Interval is the time between polls
+	Interval time.Duration
+	// Lag keeps the end of each window this far behind the current time,
+	// for flows the API reports late
+	Lag time.Duration
+	// StateFile holds the watermark of every tenant
+	StateFile string
+	// OutputFile names the hourly files as outputFileFor does for days
+	OutputFile string
+}
+
+// followState is the progress of -follow. It is saved after every window so
+// that a restarted run continues from the watermark of each tenant.
+type followState struct {
+	Tenants map[string]*followProgress `json:"tenants"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// followProgress is the progress of one tenant
+type followProgress struct {
+	// Watermark is the end of the last window written
+	Watermark time.Time `json:"watermark"`
+
+	// PendingFile and PendingSize are the file a window is being appended to
+	// and its size before, so that rows of an interrupted write can be
+	// removed on restart
+	PendingFile string `json:"pending_file,omitempty"`
+	PendingSize int64  `json:"pending_size,omitempty"`
+
+	// Finished are complete hourly files not uploaded yet
+	Finished []string `json:"finished,omitempty"`
+}
+
+// loadFollowState reads the state file, or returns an empty state when there
+// is none yet
+func loadFollowState(path string) (*followState, error) {
+	state := &followState{Tenants: make(map[string]*followProgress), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error reading follow state %s: %v", path, err)
+	}
+	if state.Tenants == nil {
+		state.Tenants = make(map[string]*followProgress)
+	}
+	return state, nil
+}
+
+// save writes the state through a temporary file. The caller holds mu.
+func (s *followState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing follow state: %v", err)
+	}
+	return nil
+}
+
+// update changes the progress of tenant and saves the state
+func (s *followState) update(tenant string, fn func(*followProgress)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.Tenants[tenant])
+	return s.save()
+}
+
+// progress returns a copy of the progress of tenant
+func (s *followState) progress(tenant string) followProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress := *s.Tenants[tenant]
+	progress.Finished = append([]string(nil), progress.Finished...)
+	return progress
+}
+
+// runFollow polls the flows of tenants every opts.Interval until ctx is done.
+// Each poll fetches the flows since the watermark of a tenant, one window
+// per hour at most, and appends them to the file of that hour; the
+// watermark is saved once the rows are on disk. Complete hourly files are
+// passed to upload, if not nil.
+func runFollow(ctx context.Context, client *cloudsecure.Client, tenants []string, opts fetchOptions, follow followOptions, upload func(string) error) error {
+	state, err := loadFollowState(follow.StateFile)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now().Add(-follow.Lag - follow.Interval).UTC().Truncate(time.Second)
+	for _, tenant := range tenants {
+		progress, ok := state.Tenants[tenant]
+		if !ok {
+			state.Tenants[tenant] = &followProgress{Watermark: start}
+			fmt.Printf("Following %s from %s\n", tenant, start.Format(time.RFC3339))
+			continue
+		}
+		if progress.PendingFile != "" {
+			if err := truncatePending(progress.PendingFile, progress.PendingSize); err != nil {
+				return err
+			}
+			fmt.Printf("Removed the rows of an interrupted write from %s\n", progress.PendingFile)
+			progress.PendingFile, progress.PendingSize = "", 0
+		}
+		fmt.Printf("Following %s from watermark %s\n", tenant, progress.Watermark.Format(time.RFC3339))
+	}
+	if err := state.save(); err != nil {
+		return err
+	}
+
+	ext := cloudsecure.FormatExtension(opts.Format) + cloudsecure.CompressionExtension(opts.Compress)
+	var wg sync.WaitGroup
+	for _, tenant := range tenants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var dedup *cloudsecure.Deduplicator
+			if opts.Dedup {
+				dedup, _ = cloudsecure.NewDeduplicator(opts.DedupKey)
+			}
+			for {
+				if err := followTenant(ctx, client, tenant, state, opts, follow, ext, dedup); err != nil && ctx.Err() == nil {
+					fmt.Printf("Error following %s, retrying at the next poll: %v\n", tenant, err)
+				}
+				if upload != nil {
+					uploadFinished(tenant, state, upload)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(follow.Interval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("Stopped following, watermarks are saved in %s\n", follow.StateFile)
+	return nil
+}
+
+// followTenant writes the windows of tenant from its watermark up to the
+// current time less the lag
+func followTenant(ctx context.Context, client *cloudsecure.Client, tenant string, state *followState, opts fetchOptions, follow followOptions, ext string, dedup *cloudsecure.Deduplicator) error {
+	for ctx.Err() == nil {
+		from := state.progress(tenant).Watermark
+		end := time.Now().Add(-follow.Lag).UTC().Truncate(time.Second)
+		if !from.Before(end) {
+			return nil
+		}
+
+		// windows never cross an hour, so each one goes to a single file
+		hour := from.Truncate(time.Hour)
+		to := hour.Add(time.Hour)
+		if to.After(end) {
+			to = end
+		}
+		outputFile := hourlyFileFor(follow.OutputFile, tenant, ext, hour)
+
+		rows, err := followWindow(ctx, client, tenant, cloudsecure.Segment{From: from, To: to}, outputFile, state, opts, dedup)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s to %s: %d flows appended to %s\n", tenant, from.Format(time.RFC3339), to.Format(time.RFC3339), rows, outputFile)
+	}
+	return nil
+}
+
+// followWindow fetches one window of tenant and appends it to outputFile. The
+// window is fetched completely before anything is written, and the file size
+// is recorded in the state while writing, so that a failed window leaves the
+// file as it was.
+func followWindow(ctx context.Context, client *cloudsecure.Client, tenant string, window cloudsecure.Segment, outputFile string, state *followState, opts fetchOptions, dedup *cloudsecure.Deduplicator) (int, error) {
+	var spoolFiles []string
+	var segments []cloudsecure.Segment
+	defer func() {
+		for _, spoolFile := range spoolFiles {
+			os.Remove(spoolFile)
+		}
+	}()
+
+	// segments are fetched one at a time, so halves of a split segment come
+	// back in order
+	planner := cloudsecure.NewSegmentPlanner(window.From, window.To, client.Segments)
+	for {
+		seg, ok := planner.Next()
+		if !ok {
+			break
+		}
+		spoolFile, count, _, err := fetchSegment(ctx, client, tenant, outputFile, seg, opts.Filter)
+		if err == nil && !planner.ShouldSplit(seg, count) {
+			spoolFiles = append(spoolFiles, spoolFile)
+			segments = append(segments, seg)
+		} else if spoolFile != "" {
+			os.Remove(spoolFile)
+		}
+		planner.Done(seg, count, err)
+	}
+	if err := planner.Err(); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(outputFile)
+	var size int64
+	switch {
+	case err == nil:
+		size = info.Size()
+	case !os.IsNotExist(err):
+		return 0, err
+	}
+	err = state.update(tenant, func(p *followProgress) {
+		p.PendingFile, p.PendingSize = outputFile, size
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := appendFlows(outputFile, size, spoolFiles, segments, opts, dedup)
+	if err != nil {
+		if truncErr := truncatePending(outputFile, size); truncErr != nil {
+			fmt.Printf("Error restoring %s: %v\n", outputFile, truncErr)
+		}
+		return 0, err
+	}
+
+	err = state.update(tenant, func(p *followProgress) {
+		p.Watermark = window.To
+		p.PendingFile, p.PendingSize = "", 0
+		if window.To.Equal(window.From.Truncate(time.Hour).Add(time.Hour)) {
+			p.Finished = append(p.Finished, outputFile)
+		}
+	})
+	return rows, err
+}
+
+// appendFlows writes the flows of the spool files to outputFile, which
+// holds size bytes, and syncs it to disk. Unlike other output files it is
+// appended to in place rather than written through a temporary file, which
+// would copy the whole hourly file for every window: the follow state records
+// the size before the append, so a window cut short by a crash is truncated
+// away on the next start, and the file is only uploaded once its hour is
+// finished.
+func appendFlows(outputFile string, size int64, spoolFiles []string, segments []cloudsecure.Segment, opts fetchOptions, dedup *cloudsecure.Deduplicator) (int, error) {
+	mapper := opts.Mapper
+	if mapper == nil {
+		mapper = cloudsecure.DefaultMapper
+	}
+	if opts.Enrich {
+		mapper = cloudsecure.NewEnrichedMapper(mapper)
+	}
+
+	file, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	// each window is a compressed stream of its own, appended to the file
+	output, err := cloudsecure.NewCompressWriter(opts.Compress, file)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+
+	var writer cloudsecure.RecordWriter
+	if size == 0 {
+		writer, err = cloudsecure.NewRecordWriter(opts.Format, output, mapper.Columns())
+	} else {
+		writer, err = cloudsecure.NewAppendRecordWriter(opts.Format, output, mapper.Columns())
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	for i, spoolFile := range spoolFiles {
+		if dedup != nil {
+			dedup.StartSegment(segments[i].From)
+		}
+		err := readPart(spoolFile, func(flow cloudsecure.Flow) error {
+			if dedup != nil {
+				if seen, err := dedup.Seen(flow); err != nil || seen {
+					return err
+				}
+			}
+			record, err := mapper.Record(flow)
+			if err != nil {
+				return err
+			}
+			rows++
+			return writer.Write(record)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error writing to %s: %v", outputFile, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	if err := output.Close(); err != nil {
+		return 0, fmt.Errorf("error compressing %s: %v", outputFile, err)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("error syncing %s: %v", outputFile, err)
+	}
+	if size == 0 {
+		syncDir(filepath.Dir(outputFile))
+	}
+	return rows, file.Close()
+}
+
+// truncatePending cuts fileName back to size, removing it when it was empty
+func truncatePending(fileName string, size int64) error {
+	var err error
+	if size == 0 {
+		err = os.Remove(fileName)
+	} else {
+		err = os.Truncate(fileName, size)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error restoring %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// uploadFinished uploads the complete hourly files of tenant. Files that fail
+// stay in the state and are tried again after the next poll.
+func uploadFinished(tenant string, state *followState, upload func(string) error) {
+	for _, fileName := range state.progress(tenant).Finished {
+		if err := upload(fileName); err != nil {
+			fmt.Printf("Error uploading %s to S3: %v\n", fileName, err)
+			return
+		}
+		fmt.Printf("Uploaded %s to S3\n", fileName)
+		err := state.update(tenant, func(p *followProgress) {
+			if len(p.Finished) > 0 && p.Finished[0] == fileName {
+				p.Finished = p.Finished[1:]
+			}
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// hourlyFileFor returns the file of one hour of tenant: named after the
+// tenant and hour without -out, or with the tenant and hour added before the
+// extension of -out
+func hourlyFileFor(outputFile, tenant, ext string, hour time.Time) string {
+	stamp := hour.UTC().Format(hourFormat)
+	if outputFile == "" {
+		return tenant + "_" + stamp + ext
+	}
+	outExt := fileExt(outputFile)
+	return strings.TrimSuffix(outputFile, outExt) + "_" + tenant + "_" + stamp + outExt
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// partTimeFormat names segment files after the window they hold
+const partTimeFormat = "20060102T150405Z"
+
+// manifestVersion changes whenever the format of the segment files does, so
+// that segments of an older version are fetched again instead of resumed
+const manifestVersion = 2
+
+// segmentManifest records which segments of an output file have been fetched.
+// It is stored next to the output as <output>.manifest.json, and the flows of
+// each completed segment are kept in <output>.parts until the run finishes,
+// one JSON object per line as received from the API.
+type segmentManifest struct {
+	Version   int                     `json:"version"`
+	Tenant    string                  `json:"tenant"`
+	From      time.Time               `json:"from"`
+	To        time.Time               `json:"to"`
+	Filter    *cloudsecure.FlowFilter `json:"filter,omitempty"`
+	Complete  bool                    `json:"complete"`
+	Segments  []manifestEntry         `json:"segments"`
+	Abandoned []cloudsecure.Segment   `json:"abandoned,omitempty"`
+
+	mu       sync.Mutex
+	base     string
+	path     string
+	partsDir string
+}
+
+// manifestEntry is one completed segment. A truncated segment still returned
+// max_results flows at the minimum segment size, so some of its flows are
+// missing; it keeps the run from completing and is fetched again on resume.
+type manifestEntry struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Rows      int       `json:"rows"`
+	SHA256    string    `json:"sha256"`
+	File      string    `json:"file"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// openManifest returns the manifest for a run of tenant over [from, to) with
+// filter, stored as base.manifest.json with segment files in base.parts. With resume
+// the previous manifest is reused and segments whose files are missing or do
+// not match their checksum are dropped; otherwise any previous manifest and
+// parts are discarded.
+func openManifest(base, tenant string, from, to time.Time, filter *cloudsecure.FlowFilter, resume bool) (*segmentManifest, error) {
+	if filter.IsEmpty() {
+		filter = nil
+	}
+	m := &segmentManifest{
+		Version:  manifestVersion,
+		Tenant:   tenant,
+		From:     from,
+		To:       to,
+		Filter:   filter,
+		base:     base,
+		path:     base + ".manifest.json",
+		partsDir: base + ".parts",
+	}
+
+	if resume {
+		previous, err := loadManifest(m.path)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("No manifest found for %s, fetching all segments\n", base)
+		case err != nil:
+			return nil, err
+		case previous.Version != manifestVersion || previous.Tenant != tenant || !previous.From.Equal(from) || !previous.To.Equal(to) ||
+			!reflect.DeepEqual(previous.Filter, filter):
+			fmt.Printf("Manifest %s belongs to a different run, fetching all segments\n", m.path)
+		case previous.Complete:
+			m.Complete = true
+			m.Segments = previous.Segments
+			return m, nil
+		default:
+			for _, entry := range previous.Segments {
+				if entry.Truncated {
+					fmt.Printf("Fetching truncated segment %s again\n", entry.segment())
+					continue
+				}
+				if err := m.verify(entry); err != nil {
+					fmt.Printf("Discarding segment %s: %v\n", entry.segment(), err)
+					continue
+				}
+				m.Segments = append(m.Segments, entry)
+			}
+			fmt.Printf("Resuming %s with %d completed segments\n", base, len(m.Segments))
+			return m, nil
+		}
+	}
+
+	if err := os.RemoveAll(m.partsDir); err != nil {
+		return nil, fmt.Errorf("error removing old segment files: %v", err)
+	}
+	return m, m.save()
+}
+
+func loadManifest(path string) (*segmentManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m segmentManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", path, err)
+	}
+	return &m, nil
+}
+
+// save writes the manifest through a temporary file so that an interrupted
+// write never leaves a truncated manifest behind
+func (m *segmentManifest) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	return nil
+}
+
+// missing returns the parts of [From, To) not covered by completed segments
+func (m *segmentManifest) missing() []cloudsecure.Segment {
+	m.mu.Lock()
+	entries := append([]manifestEntry(nil), m.Segments...)
+	m.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].From.Before(entries[j].From) })
+
+	var gaps []cloudsecure.Segment
+	cursor := m.From
+	for _, entry := range entries {
+		if entry.From.After(cursor) {
+			gaps = append(gaps, cloudsecure.Segment{From: cursor, To: entry.From})
+		}
+		if entry.To.After(cursor) {
+			cursor = entry.To
+		}
+	}
+	if cursor.Before(m.To) {
+		gaps = append(gaps, cloudsecure.Segment{From: cursor, To: m.To})
+	}
+	return gaps
+}
+
+// addPart moves a finished segment file into the parts directory and records
+// it in the manifest
+func (m *segmentManifest) addPart(seg cloudsecure.Segment, spoolFile string, rows int, truncated bool) error {
+	if err := os.MkdirAll(m.partsDir, 0755); err != nil {
+		return fmt.Errorf("error creating %s: %v", m.partsDir, err)
+	}
+
+	entry := manifestEntry{
+		From:      seg.From,
+		To:        seg.To,
+		Rows:      rows,
+		File:      seg.From.UTC().Format(partTimeFormat) + "-" + seg.To.UTC().Format(partTimeFormat) + ".ndjson",
+		Truncated: truncated,
+	}
+	partFile := filepath.Join(m.partsDir, entry.File)
+	if err := os.Rename(spoolFile, partFile); err != nil {
+		return fmt.Errorf("error saving segment file: %v", err)
+	}
+
+	sum, err := fileChecksum(partFile)
+	if err != nil {
+		return err
+	}
+	entry.SHA256 = sum
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Segments = append(m.Segments, entry)
+	return m.save()
+}
+
+// verify checks that the file of a completed segment is intact
+func (m *segmentManifest) verify(entry manifestEntry) error {
+	sum, err := fileChecksum(filepath.Join(m.partsDir, entry.File))
+	if err != nil {
+		return err
+	}
+	if sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// completed returns every completed segment in chronological order
+func (m *segmentManifest) completed() []manifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(m.Segments, func(i, j int) bool { return m.Segments[i].From.Before(m.Segments[j].From) })
+	return append([]manifestEntry(nil), m.Segments...)
+}
+
+// truncated returns the segments recorded as truncated
+func (m *segmentManifest) truncated() []cloudsecure.Segment {
+	var segments []cloudsecure.Segment
+	for _, entry := range m.completed() {
+		if entry.Truncated {
+			segments = append(segments, entry.segment())
+		}
+	}
+	return segments
+}
+
+// segmentFiles returns the files of every completed segment in chronological order
+func (m *segmentManifest) segmentFiles() []string {
+	var files []string
+	for _, entry := range m.completed() {
+		files = append(files, filepath.Join(m.partsDir, entry.File))
+	}
+	return files
+}
+
+// abandon records the segments an interrupted run did not fetch
+func (m *segmentManifest) abandon(segments []cloudsecure.Segment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Abandoned = segments
+	return m.save()
+}
+
+// finish marks the run as complete and removes the segment files
+func (m *segmentManifest) finish() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Complete = true
+	m.Abandoned = nil
+	if err := os.RemoveAll(m.partsDir); err != nil {
+		return fmt.Errorf("error removing segment files: %v", err)
+	}
+	return m.save()
+}
+
+func (e manifestEntry) segment() cloudsecure.Segment {
+	return cloudsecure.Segment{From: e.From, To: e.To}
+}
+
+// fileChecksum returns the hex encoded SHA-256 of a file
+func fileChecksum(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading %s: %v", fileName, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// assembleOutput writes outputFile from the completed segments of each
+// manifest in chronological order, so the result does not depend on the
+// order in which segments finished. The rows are built by opts.Mapper, or
+// from every field with opts.AllFields, followed by the endpoint metadata
+// columns with opts.Enrich, and written in opts.Format. With
+// withTenant every row gets the tenant of its manifest as an extra column.
+// With opts.Dedup flows returned by more than one segment of a tenant are
+// written once, and the number of duplicates dropped is returned. With
+// opts.Aggregate the flows of each tenant are summed into one row per group
+// and bucket instead.
+func assembleOutput(outputFile string, manifests []*segmentManifest, withTenant bool, opts fetchOptions) (int, error) {
+	var mapper cloudsecure.FlowMapper
+	var columns []cloudsecure.Column
+	if opts.Aggregate {
+		aggregator, err := cloudsecure.NewAggregator(opts.AggregateKey, opts.Bucket)
+		if err != nil {
+			return 0, err
+		}
+		columns = aggregator.Columns()
+	} else {
+		var err error
+		if mapper, err = outputMapper(manifests, opts); err != nil {
+			return 0, err
+		}
+		if opts.Enrich {
+			mapper = cloudsecure.NewEnrichedMapper(mapper)
+		}
+		columns = mapper.Columns()
+	}
+
+	// written under a temporary name and renamed once complete
+	file, err := createAtomic(outputFile, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+	output, err := cloudsecure.NewCompressWriter(opts.Compress, file)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Close()
+
+	if withTenant {
+		columns = append(append([]cloudsecure.Column(nil), columns...), cloudsecure.Column{Name: tenantColumn})
+	}
+	writer, err := cloudsecure.NewRecordWriter(opts.Format, output, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	duplicates := 0
+	for _, manifest := range manifests {
+		write := func(record []string) error {
+			if withTenant {
+				record = append(record, manifest.Tenant)
+			}
+			return writer.Write(record)
+		}
+
+		var dedup *cloudsecure.Deduplicator
+		if opts.Dedup {
+			if dedup, err = cloudsecure.NewDeduplicator(opts.DedupKey); err != nil {
+				return 0, err
+			}
+		}
+		var aggregator *cloudsecure.Aggregator
+		if opts.Aggregate {
+			if aggregator, err = cloudsecure.NewAggregator(opts.AggregateKey, opts.Bucket); err != nil {
+				return 0, err
+			}
+		}
+
+		flows := 0
+		for _, entry := range manifest.completed() {
+			if dedup != nil {
+				dedup.StartSegment(entry.From)
+			}
+			err := readPart(filepath.Join(manifest.partsDir, entry.File), func(flow cloudsecure.Flow) error {
+				if dedup != nil {
+					if seen, err := dedup.Seen(flow); err != nil || seen {
+						return err
+					}
+				}
+				flows++
+				if aggregator != nil {
+					return aggregator.Add(flow)
+				}
+				record, err := mapper.Record(flow)
+				if err != nil {
+					return err
+				}
+				return write(record)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("error writing segment to %s: %v", outputFile, err)
+			}
+		}
+		if dedup != nil {
+			duplicates += dedup.Removed()
+		}
+		if aggregator != nil {
+			fmt.Printf("Aggregated %d %s flows into %d rows\n", flows, manifest.Tenant, aggregator.Len())
+			if err := aggregator.Records(write); err != nil {
+				return 0, fmt.Errorf("error writing aggregated rows to %s: %v", outputFile, err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	if err := output.Close(); err != nil {
+		return 0, fmt.Errorf("error compressing %s: %v", outputFile, err)
+	}
+	return duplicates, file.Commit()
+}
+
+// outputMapper returns the FlowMapper for opts. With opts.AllFields the
+// segment files are read once to find every field.
+func outputMapper(manifests []*segmentManifest, opts fetchOptions) (cloudsecure.FlowMapper, error) {
+	if !opts.AllFields {
+		if opts.Mapper == nil {
+			return cloudsecure.DefaultMapper, nil
+		}
+		return opts.Mapper, nil
+	}
+
+	collector := cloudsecure.NewFieldCollector()
+	for _, manifest := range manifests {
+		for _, partFile := range manifest.segmentFiles() {
+			if err := readPart(partFile, collector.Add); err != nil {
+				return nil, err
+			}
+		}
+	}
+	specs := collector.Specs()
+	if len(specs) == 0 {
+		return cloudsecure.DefaultMapper, nil
+	}
+	return cloudsecure.NewColumnMapper(specs)
+}
+
+// readPart calls fn with each flow of a segment file
+func readPart(partFile string, fn func(cloudsecure.Flow) error) error {
+	part, err := os.Open(partFile)
+	if err != nil {
+		return fmt.Errorf("error opening segment file: %v", err)
+	}
+	defer part.Close()
+
+	reader := bufio.NewReader(part)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var flow cloudsecure.Flow
+			if err := json.Unmarshal(data, &flow); err != nil {
+				return fmt.Errorf("%s line %d: %v", filepath.Base(partFile), line, err)
+			}
+			if err := fn(flow); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading segment file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// privateBlocks are the networks filter_cli does not count as Internet
+var privateBlocks = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"127.0.0.0/8", "224.0.0.0/4", "255.255.255.255/32",
+	"fc00::/7", "fe80::/10", "::1/128", "ff00::/8",
+}
+
+// filterPreset is a filter_cli preset, as stored in its presets.json
+type filterPreset struct {
+	Name       string `json:"name"`
+	Conditions []struct {
+		Field     string
+		Operator  string
+		ListFiles []string
+	} `json:"conditions"`
+	FlowStatus string `json:"flow_status"`
+}
+
+// presetFilter builds a flow filter from the filter_cli preset name in
+// presetsFile. IP list files are read relative to presetsFile. Conditions
+// the filter cannot express exactly, such as Internet mixed with IP lists
+// or != Internet, which filter_cli also keeps hostnames for, are left out or
+// loosened, so the filter may keep more flows than the preset and filter_cli
+// should still be run on the output.
+func presetFilter(presetsFile, name string) (*cloudsecure.FlowFilter, error) {
+	data, err := os.ReadFile(presetsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading presets: %v", err)
+	}
+	var presets []filterPreset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("error reading presets: %v", err)
+	}
+
+	var preset *filterPreset
+	for i := range presets {
+		if presets[i].Name == name {
+			preset = &presets[i]
+			break
+		}
+	}
+	if preset == nil {
+		return nil, fmt.Errorf("preset '%s' not found in %s", name, presetsFile)
+	}
+
+	filter := &cloudsecure.FlowFilter{}
+	if preset.FlowStatus != "" {
+		filter.Statuses = []string{preset.FlowStatus}
+	}
+
+	dir := filepath.Dir(presetsFile)
+	for _, cond := range preset.Conditions {
+		var include, exclude *[]string
+		switch cond.Field {
+		case "sourceIP":
+			include, exclude = &filter.SrcCIDRs, &filter.ExcludeSrcCIDRs
+		case "destIP":
+			include, exclude = &filter.DstCIDRs, &filter.ExcludeDstCIDRs
+		default:
+			fmt.Printf("Preset %s: field %s cannot be used in the flow filter, skipped\n", name, cond.Field)
+			continue
+		}
+
+		var cidrs []string
+		internet := false
+		for _, listFile := range cond.ListFiles {
+			if listFile == "Internet" {
+				internet = true
+				continue
+			}
+			if !filepath.IsAbs(listFile) {
+				listFile = filepath.Join(dir, listFile)
+			}
+			list, err := readIPList(listFile)
+			if err != nil {
+				return nil, err
+			}
+			cidrs = append(cidrs, list...)
+		}
+
+		switch {
+		case internet && len(cidrs) > 0 && cond.Operator == "==":
+			// in a list or on the Internet cannot be expressed as a single filter
+			fmt.Printf("Preset %s: condition on %s mixes Internet and IP lists, left to filter_cli\n", name, cond.Field)
+		case cond.Operator == "==" && internet:
+			*exclude = append(*exclude, privateBlocks...)
+		case cond.Operator == "==":
+			*include = append(*include, cidrs...)
+		case cond.Operator == "!=":
+			*exclude = append(*exclude, cidrs...)
+			if internet {
+				// filter_cli keeps endpoints without an IP address here,
+				// which no list of networks can include
+				fmt.Printf("Preset %s: condition on %s excludes Internet, left to filter_cli\n", name, cond.Field)
+			}
+		default:
+			return nil, fmt.Errorf("preset %s: unknown operator %q", name, cond.Operator)
+		}
+	}
+	return filter, nil
+}
+
+// readIPList reads an IP list file in the filter_cli format, one IP or CIDR per line
+func readIPList(fileName string) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening IP list file: %v", err)
+	}
+	defer file.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			list = append(list, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading IP list file: %v", err)
+	}
+	return list, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parsePorts parses a comma separated list of ports
+func parsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, item := range splitList(value) {
+		port, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
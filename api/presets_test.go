@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+func TestPresetFilter(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "internal.txt"), []byte("10.1.0.0/16\n192.168.5.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	presets := `[
+		{"name": "in", "conditions": [{"Field": "sourceIP", "Operator": "==", "ListFiles": ["internal.txt"]}], "flow_status": "ALLOWED"},
+		{"name": "internet", "conditions": [{"Field": "destIP", "Operator": "==", "ListFiles": ["Internet"]}]},
+		{"name": "not", "conditions": [{"Field": "destIP", "Operator": "!=", "ListFiles": ["internal.txt", "Internet"]}]},
+		{"name": "mixed", "conditions": [{"Field": "sourceIP", "Operator": "==", "ListFiles": ["internal.txt", "Internet"]}]}
+	]`
+	presetsFile := filepath.Join(dir, "presets.json")
+	if err := os.WriteFile(presetsFile, []byte(presets), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want cloudsecure.FlowFilter
+	}{
+		{"in", cloudsecure.FlowFilter{Statuses: []string{"ALLOWED"}, SrcCIDRs: []string{"10.1.0.0/16", "192.168.5.10"}}},
+		{"internet", cloudsecure.FlowFilter{ExcludeDstCIDRs: privateBlocks}},
+		// != Internet also keeps endpoints without an IP address in
+		// filter_cli, so only the IP lists are excluded
+		{"not", cloudsecure.FlowFilter{ExcludeDstCIDRs: []string{"10.1.0.0/16", "192.168.5.10"}}},
+		{"mixed", cloudsecure.FlowFilter{}},
+	}
+	for _, tt := range tests {
+		got, err := presetFilter(presetsFile, tt.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: presetFilter = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+
+	if _, err := presetFilter(presetsFile, "missing"); err == nil {
+		t.Error("presetFilter of a missing preset succeeded")
+	}
+}
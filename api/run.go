@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+)
+
+// fetchJob is one output file: one day of a single tenant, or of several
+// tenants combined
+type fetchJob struct {
+	Tenants []string
+	Date    time.Time
+	Output  string
+}
+
+// jobResult is the outcome of a fetchJob
+type jobResult struct {
+	fetchJob
+	Err        error
+	Uploaded   bool
+	Duplicates int
+}
+
+// planJobs returns the jobs for tenants over dates. Jobs in the same inner
+// slice run one after another, the slices run in parallel: one per tenant,
+// or a single one when the tenants are combined into one file per day.
+func planJobs(tenants []string, dates []time.Time, outputFile, ext string, combined bool) [][]fetchJob {
+	multipleDays := len(dates) > 1
+
+	if combined || len(tenants) == 1 {
+		var jobs []fetchJob
+		for _, date := range dates {
+			jobs = append(jobs, fetchJob{
+				Tenants: tenants,
+				Date:    date,
+				Output:  outputFileFor(outputFile, "", ext, date, multipleDays),
+			})
+		}
+		return [][]fetchJob{jobs}
+	}
+
+	var plan [][]fetchJob
+	for _, tenant := range tenants {
+		var jobs []fetchJob
+		for _, date := range dates {
+			jobs = append(jobs, fetchJob{
+				Tenants: []string{tenant},
+				Date:    date,
+				Output:  outputFileFor(outputFile, tenant, ext, date, multipleDays),
+			})
+		}
+		plan = append(plan, jobs)
+	}
+	return plan
+}
+
+// runJobs runs a plan from planJobs and returns the result of every job.
+// A failed job does not stop the others; once ctx is done the remaining
+// jobs are reported as abandoned. upload, if not nil, is called with the
+// output of each successful job.
+func runJobs(ctx context.Context, client *cloudsecure.Client, plan [][]fetchJob, opts fetchOptions, upload func(string) error) []jobResult {
+	var mu sync.Mutex
+	var results []jobResult
+	record := func(result jobResult) {
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, jobs := range plan {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, job := range jobs {
+				if ctx.Err() != nil {
+					record(jobResult{fetchJob: job, Err: fmt.Errorf("abandoned: %v", ctx.Err())})
+					continue
+				}
+
+				fmt.Printf("Retrieving data of %s for %s into %s\n", strings.Join(job.Tenants, ", "), job.Date.Format("20060102"), job.Output)
+				result := jobResult{fetchJob: job}
+				result.Duplicates, result.Err = fetchDay(ctx, client, job.Tenants, job.Date, job.Output, opts)
+				if result.Err == nil && upload != nil {
+					if err := upload(job.Output); err != nil {
+						result.Err = fmt.Errorf("error uploading to S3: %v", err)
+					} else {
+						result.Uploaded = true
+					}
+				}
+				record(result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Date.Equal(results[j].Date) {
+			return results[i].Date.Before(results[j].Date)
+		}
+		return results[i].Output < results[j].Output
+	})
+	return results
+}
+
+// printSummary prints one line per job and reports whether all succeeded.
+// With dedup the duplicates removed from each file and in total are shown.
+func printSummary(results []jobResult, dedup bool) bool {
+	ok := true
+	total := 0
+	fmt.Println("Summary:")
+	for _, result := range results {
+		tenants := strings.Join(result.Tenants, ",")
+		day := result.Date.Format("20060102")
+		var notes []string
+		if dedup {
+			notes = append(notes, fmt.Sprintf("%d duplicates removed", result.Duplicates))
+			total += result.Duplicates
+		}
+		if result.Uploaded {
+			notes = append(notes, "uploaded to S3")
+		}
+		switch {
+		case result.Err != nil:
+			ok = false
+			fmt.Printf("  FAILED  %s %s: %v\n", tenants, day, result.Err)
+		case len(notes) > 0:
+			fmt.Printf("  OK      %s %s: %s (%s)\n", tenants, day, result.Output, strings.Join(notes, ", "))
+		default:
+			fmt.Printf("  OK      %s %s: %s\n", tenants, day, result.Output)
+		}
+	}
+	if dedup {
+		fmt.Printf("Duplicate flows removed: %d\n", total)
+	}
+	return ok
+}
+
+// outputFileFor returns the output file for one day and, when tenants get
+// separate files, one tenant. Without -out the file is named after the tenant
+// and day with extension ext; with -out the tenant and, for several days, the
+// date are added before the extension.
+func outputFileFor(outputFile, tenant, ext string, date time.Time, multipleDays bool) string {
+	day := date.Format("20060102")
+	if outputFile == "" {
+		if tenant != "" {
+			return tenant + "_" + day + ext
+		}
+		return day + ext
+	}
+
+	outExt := fileExt(outputFile)
+	name := strings.TrimSuffix(outputFile, outExt)
+	if tenant != "" {
+		name += "_" + tenant
+	}
+	if multipleDays {
+		name += "_" + day
+	}
+	return name + outExt
+}
+
+// fileExt returns the extension of fileName, including the format before a
+// compression extension such as .csv.gz
+func fileExt(fileName string) string {
+	ext := filepath.Ext(fileName)
+	for _, compression := range cloudsecure.Compressions {
+		if ext == cloudsecure.CompressionExtension(compression) {
+			return filepath.Ext(strings.TrimSuffix(fileName, ext)) + ext
+		}
+	}
+	return ext
+}
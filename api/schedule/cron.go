@@ -0,0 +1,249 @@
+// Package schedule parses cron expressions and works out when they fire.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	expr    string
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	anyDom  bool
+	anyDow  bool
+	anyHour bool
+	loc     *time.Location
+}
+
+// field is one of the five fields of a cron expression
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12,
+		names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField = field{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// macros are the named schedules accepted in place of the five fields
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a standard five field cron expression: minute, hour, day of
+// month, month and day of week. Fields take *, numbers, names of months and
+// days, ranges (1-5), lists (1,15) and steps (*/15, 0-30/10); a day of week
+// of 0 or 7 is Sunday. As in cron, when both day fields are restricted a day
+// matching either of them fires. The macros @hourly, @daily, @midnight,
+// @weekly, @monthly, @yearly and @annually are accepted too. Times are in loc,
+// or UTC when loc is nil.
+func Parse(expr string, loc *time.Location) (*Schedule, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	spec := strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{expr: expr, loc: loc}
+	var err error
+	if s.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.anyDom = strings.HasPrefix(fields[2], "*")
+	s.anyDow = strings.HasPrefix(fields[4], "*")
+	s.anyHour = fields[1] == "*"
+	return s, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Location returns the time zone of the schedule
+func (s *Schedule) Location() *time.Location {
+	return s.loc
+}
+
+// Next returns the first time the schedule fires after t, or the zero time
+// when it never does (such as on February 30). As in cron, a time skipped when
+// clocks go forward does not fire, and a time repeated when they go back
+// fires once, unless the hour field is *.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+
+	// five years covers every combination of the fields, including leap days
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			if !next.After(t) {
+				// midnight skipped by a daylight saving change
+				next = t.Add(time.Hour)
+			}
+			t = next
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			// the start of the next hour in elapsed time, so that hours
+			// skipped or repeated by a daylight saving change are stepped
+			// over; minutes rather than Truncate keep zones with half hour
+			// offsets on the hour
+			t = t.Add(-time.Duration(t.Minute()) * time.Minute).Add(time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 || (!s.anyHour && repeated(t)) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Between returns the times the schedule fires after from and up to and
+// including to, the last max of them when there are more
+func (s *Schedule) Between(from, to time.Time, max int) []time.Time {
+	var times []time.Time
+	for t := s.Next(from); !t.IsZero() && !t.After(to); t = s.Next(t) {
+		times = append(times, t)
+		if len(times) > max {
+			times = times[1:]
+		}
+	}
+	return times
+}
+
+// repeated reports whether the wall clock time of t already occurred earlier
+// the same day, in the hour repeated when clocks go back
+func repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	_, before := t.Add(-2 * time.Hour).Zone()
+	if before <= offset {
+		return false
+	}
+	twin := t.Add(-time.Duration(before-offset) * time.Second)
+	_, twinOffset := twin.Zone()
+	return twinOffset == before && twin.Hour() == t.Hour() && twin.Minute() == t.Minute()
+}
+
+// dayMatches reports whether the day fields allow the day of t
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dow
+	case s.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// parseField returns the values allowed by one field as a bit set
+func parseField(text string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		rangeText, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangeText = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+			}
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case rangeText == "*":
+		case strings.Contains(rangeText, "-"):
+			bounds := strings.SplitN(rangeText, "-", 2)
+			var err error
+			if low, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+			}
+		default:
+			value, err := f.value(rangeText)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a number or name of the field
+func (f field) value(text string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("invalid %s %q, expected %d-%d", f.name, text, f.min, f.max)
+	}
+	return value, nil
+}
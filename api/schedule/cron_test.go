@@ -0,0 +1,139 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"@sometimes",
+	} {
+		if _, err := Parse(expr, nil); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork := mustLoad(t, "America/New_York")
+	kolkata := mustLoad(t, "Asia/Kolkata")
+	utc := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from string
+		want string
+	}{
+		{"every minute", "* * * * *", time.UTC, "2026-01-01T10:00:30Z", "2026-01-01T10:01:00Z"},
+		{"step", "*/15 * * * *", time.UTC, "2026-01-01T10:01:00Z", "2026-01-01T10:15:00Z"},
+		{"list and range", "0 8-9,17 * * *", time.UTC, "2026-01-01T09:30:00Z", "2026-01-01T17:00:00Z"},
+		{"macro", "@daily", time.UTC, "2026-01-01T00:00:00Z", "2026-01-02T00:00:00Z"},
+		{"month name", "0 0 1 jun *", time.UTC, "2026-01-01T00:00:00Z", "2026-06-01T00:00:00Z"},
+		{"weekdays", "0 12 * * mon-fri", time.UTC, "2026-01-02T12:00:00Z", "2026-01-05T12:00:00Z"},
+		{"sunday as 7", "0 0 * * 7", time.UTC, "2026-01-01T00:00:00Z", "2026-01-04T00:00:00Z"},
+		{"day of month or week", "0 0 13 * fri", time.UTC, "2026-01-10T00:00:00Z", "2026-01-13T00:00:00Z"},
+		{"leap day", "0 0 29 2 *", time.UTC, "2026-01-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"never", "0 0 30 2 *", time.UTC, "2026-01-01T00:00:00Z", ""},
+		{"time zone", "0 2 * * *", newYork, "2026-01-01T00:00:00Z", "2026-01-01T07:00:00Z"},
+		{"half hour offset", "0 * * * *", kolkata, "2026-01-01T04:45:00Z", "2026-01-01T05:30:00Z"},
+
+		// 2026-03-08 02:00 EST jumps to 03:00 EDT
+		{"skipped hour does not fire", "30 2 * * *", newYork, "2026-03-08T05:00:00Z", "2026-03-09T06:30:00Z"},
+		{"hour after the gap", "0 3 * * *", newYork, "2026-03-08T06:30:00Z", "2026-03-08T07:00:00Z"},
+
+		// 2026-11-01 02:00 EDT goes back to 01:00 EST
+		{"after first 01:30", "0 2 * * *", newYork, "2026-11-01T05:30:00Z", "2026-11-01T07:00:00Z"},
+		{"after second 01:30", "0 2 * * *", newYork, "2026-11-01T06:30:00Z", "2026-11-01T07:00:00Z"},
+		{"first of repeated time", "30 1 * * *", newYork, "2026-11-01T04:00:00Z", "2026-11-01T05:30:00Z"},
+		{"repeated time fires once", "30 1 * * *", newYork, "2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z"},
+		{"hourly fires in both hours", "30 * * * *", newYork, "2026-11-01T05:30:00Z", "2026-11-01T06:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(utc(tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next = %v, want never", got)
+				}
+				return
+			}
+			if want := utc(tt.want); !got.Equal(want) {
+				t.Errorf("Next = %v, want %v", got.UTC(), want)
+			}
+		})
+	}
+}
+
+func TestNextAcrossDSTDays(t *testing.T) {
+	// every run of the year must move forward, including the nights the
+	// clocks change
+	for _, name := range []string{"America/New_York", "Europe/Berlin", "Australia/Lord_Howe"} {
+		loc := mustLoad(t, name)
+		for _, expr := range []string{"0 2 * * *", "30 1 * * *", "0,30 * * * *"} {
+			s, err := Parse(expr, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]bool)
+			from := time.Date(2026, 1, 1, 0, 0, 0, 0, loc)
+			for next := s.Next(from); next.Year() == 2026; next = s.Next(next) {
+				if !next.After(from) {
+					t.Fatalf("%s %q: Next(%v) = %v", name, expr, from, next)
+				}
+				wall := next.Format("2006-01-02 15:04")
+				if seen[wall] && expr != "0,30 * * * *" {
+					t.Errorf("%s %q fires twice at %s", name, expr, wall)
+				}
+				seen[wall] = true
+				from = next
+			}
+		}
+	}
+}
+
+func TestBetween(t *testing.T) {
+	s, err := Parse("0 * * * *", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	got := s.Between(from, from.Add(5*time.Hour), 3)
+	if len(got) != 3 || !got[0].Equal(from.Add(3*time.Hour)) || !got[2].Equal(from.Add(5*time.Hour)) {
+		t.Errorf("Between = %v, want the last 3 hours", got)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/csmanutd/cs-traffic-filtering/api/cloudsecure"
+	"github.com/csmanutd/cs-traffic-filtering/api/schedule"
+)
+
+// maxHistory is the number of runs kept in the history file
+const maxHistory = 1000
+
+// Run statuses recorded in the history
+const (
+	runRunning     = "running"
+	runOK          = "ok"
+	runFailed      = "failed"
+	runSkipped     = "skipped"
+	runInterrupted = "interrupted"
+)
+
+// runRecord is one scheduled run of a tenant
+type runRecord struct {
+	Tenant    string    `json:"tenant"`
+	Scheduled time.Time `json:"scheduled"`
+	Date      string    `json:"date"`
+	CatchUp   bool      `json:"catch_up,omitempty"`
+	Resume    bool      `json:"resume,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// runHistory is the history of scheduled runs, saved after every change
+type runHistory struct {
+	Runs []*runRecord `json:"runs"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// loadRunHistory reads the history file, or returns an empty history when
+// there is none yet. Runs still marked as running were cut short by the end
+// of the previous process and are marked as interrupted.
+func loadRunHistory(path string) (*runHistory, error) {
+	history := &runHistory{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		return nil, fmt.Errorf("error reading run history %s: %v", path, err)
+	}
+	for _, run := range history.Runs {
+		if run.Status == runRunning {
+			run.Status = runInterrupted
+		}
+	}
+	return history, history.save()
+}
+
+// save writes the history through a temporary file. The caller holds mu
+// unless no run has started yet.
+func (h *runHistory) save() error {
+	if len(h.Runs) > maxHistory {
+		h.Runs = h.Runs[len(h.Runs)-maxHistory:]
+	}
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(h.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing run history: %v", err)
+	}
+	return nil
+}
+
+// record adds run to the history when it is not there yet, applies change
+// to it, if not nil, and saves the history. Failures to save are logged.
+func (h *runHistory) record(run *runRecord, change func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if change != nil {
+		change()
+	}
+	found := false
+	for _, existing := range h.Runs {
+		if existing == run {
+			found = true
+			break
+		}
+	}
+	if !found {
+		h.Runs = append(h.Runs, run)
+	}
+	if err := h.save(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// lastScheduled returns the latest scheduled time recorded for tenant
+func (h *runHistory) lastScheduled(tenant string) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var last time.Time
+	for _, run := range h.Runs {
+		if run.Tenant == tenant && run.Scheduled.After(last) {
+			last = run.Scheduled
+		}
+	}
+	return last
+}
+
+// unfinished returns the latest runs of tenant that failed or were
+// interrupted, for days not fetched by a later run, oldest first and at most
+// max of them
+func (h *runHistory) unfinished(tenant string, max int) []*runRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest := make(map[string]*runRecord)
+	for _, run := range h.Runs {
+		if run.Tenant == tenant && run.Status != runSkipped {
+			latest[run.Date] = run
+		}
+	}
+	var runs []*runRecord
+	for _, run := range h.Runs {
+		if latest[run.Date] == run && (run.Status == runFailed || run.Status == runInterrupted) {
+			runs = append(runs, run)
+		}
+	}
+	if len(runs) > max {
+		runs = runs[len(runs)-max:]
+	}
+	return runs
+}
+
+// scheduler starts the runs of every tenant on its schedule
+type scheduler struct {
+	history *runHistory
+	args    []string
+	catchUp int
+	output  sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// tenantSchedule is the schedule of one tenant. running is held while a run
+// of the tenant is in progress, so that runs never overlap.
+type tenantSchedule struct {
+	tenant   string
+	schedule *schedule.Schedule
+	running  sync.Mutex
+}
+
+// runServe implements the serve subcommand: it runs the fetcher for each
+// tenant on its cron schedule until it is stopped
+func runServe(args []string, configFileName string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	scheduleFlag := fs.String("schedule", "", "Cron expression for tenants without a schedule in csconfig.json, e.g. \"0 2 * * *\"")
+	csName := fs.String("cs", "all", "CloudSecure name, a comma separated list of names, or all")
+	historyFile := fs.String("history", "serve.history.json", "File keeping the history of runs")
+	catchUp := fs.Int("catch-up", 3, "Maximum missed runs per tenant started after downtime, 0 for none")
+	tz := fs.String("tz", "UTC", "Time zone of the cron expressions")
+	secretsDir := fs.String("secrets-dir", secretsDirDefault(), "Directory of secret files, passed to every run")
+	useKeyring := fs.Bool("keyring", true, "Look up credentials in the OS keyring, passed to every run")
+	configKeyFile := fs.String("config-key-file", "", "Key file of an encrypted csconfig.json, passed to every run")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: api serve [options] [-- fetch options]\n\nFetch options such as -nos3 or -format are passed to every run.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		return fmt.Errorf("invalid time zone: %v", err)
+	}
+	// runs never prompt, so tenants may come from csconfig.json or any other
+	// credential source
+	config, err := LoadConfig(configFileName, configKeyFromEnv(*configKeyFile, false))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error loading %s: %v", configFileName, err)
+	}
+	credentials, err := resolveConfig(config, *secretsDir, *useKeyring, splitList(*csName))
+	if err != nil {
+		return err
+	}
+	tenants, err := selectTenants(*csName, credentials)
+	if err != nil {
+		return err
+	}
+
+	var schedules []*tenantSchedule
+	for _, tenant := range tenants {
+		expr := config.Tenants[tenant].Schedule
+		if expr == "" {
+			expr = *scheduleFlag
+		}
+		if expr == "" {
+			expr = config.Schedule
+		}
+		if expr == "" {
+			return fmt.Errorf("no schedule for %s, use -schedule or set schedule in %s", tenant, configFileName)
+		}
+		parsed, err := schedule.Parse(expr, loc)
+		if err != nil {
+			return fmt.Errorf("invalid schedule for %s: %v", tenant, err)
+		}
+		schedules = append(schedules, &tenantSchedule{tenant: tenant, schedule: parsed})
+	}
+
+	history, err := loadRunHistory(*historyFile)
+	if err != nil {
+		return err
+	}
+	runArgs := []string{"-non-interactive", "-secrets-dir", *secretsDir, fmt.Sprintf("-keyring=%t", *useKeyring)}
+	if *configKeyFile != "" {
+		runArgs = append(runArgs, "-config-key-file", *configKeyFile)
+	}
+	s := &scheduler{history: history, args: append(runArgs, fs.Args()...), catchUp: *catchUp}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for _, ts := range schedules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveTenant(ctx, ts)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Println("Stopping, waiting for runs in progress")
+	s.wg.Wait()
+	return nil
+}
+
+// serveTenant first runs again with -resume the failed and interrupted runs
+// of a tenant, then starts its missed runs, then each run on its schedule
+// until ctx is done. A run due while the previous one is still in progress is
+// skipped.
+func (s *scheduler) serveTenant(ctx context.Context, ts *tenantSchedule) {
+	var pending []*runRecord
+	for _, previous := range s.history.unfinished(ts.tenant, s.catchUp) {
+		fmt.Printf("Resuming the %s run of %s for %s\n", previous.Status, ts.tenant, previous.Date)
+		pending = append(pending, &runRecord{Tenant: ts.tenant, Scheduled: previous.Scheduled, Date: previous.Date, CatchUp: true, Resume: true})
+	}
+	if last := s.history.lastScheduled(ts.tenant); !last.IsZero() {
+		missed := ts.schedule.Between(last, time.Now(), s.catchUp)
+		if len(missed) > 0 {
+			fmt.Printf("Catching up %d missed runs of %s\n", len(missed), ts.tenant)
+		}
+		for _, scheduled := range missed {
+			pending = append(pending, &runRecord{Tenant: ts.tenant, Scheduled: scheduled, Date: runDate(scheduled), CatchUp: true})
+		}
+	}
+	if len(pending) > 0 {
+		ts.running.Lock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer ts.running.Unlock()
+			for _, run := range pending {
+				if ctx.Err() != nil {
+					return
+				}
+				s.run(ctx, run)
+			}
+		}()
+	}
+
+	for {
+		next := ts.schedule.Next(time.Now())
+		if next.IsZero() {
+			fmt.Printf("Schedule %q of %s never fires\n", ts.schedule, ts.tenant)
+			return
+		}
+		fmt.Printf("Next run of %s at %s\n", ts.tenant, next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !ts.running.TryLock() {
+			fmt.Printf("Skipping run of %s at %s, the previous run is still in progress\n", ts.tenant, next.Format(time.RFC3339))
+			s.history.record(&runRecord{Tenant: ts.tenant, Scheduled: next, Date: runDate(next), Status: runSkipped, Error: "previous run still in progress"}, nil)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer ts.running.Unlock()
+			s.run(ctx, &runRecord{Tenant: ts.tenant, Scheduled: next, Date: runDate(next)})
+		}()
+	}
+}
+
+// run fetches the day of run by running this program again with the fetch
+// options of the serve command, and with -resume when run continues an
+// earlier one, and records the run in the history. Each run writes its own
+// file, named after the tenant and day as when several tenants are fetched at
+// once.
+func (s *scheduler) run(ctx context.Context, run *runRecord) {
+	run.Started = time.Now()
+	run.Status = runRunning
+	s.history.record(run, nil)
+	fmt.Printf("Starting run of %s for %s (scheduled %s)\n", run.Tenant, run.Date, run.Scheduled.Format(time.RFC3339))
+
+	day, err := time.Parse("20060102", run.Date)
+	if err == nil {
+		args := []string{"-cs", run.Tenant, "-date", run.Date, "-out", runOutputFile(s.args, run.Tenant, day)}
+		if run.Resume {
+			args = append(args, "-resume")
+		}
+		err = s.exec(ctx, run.Tenant, append(args, withoutFlag(s.args, "out")...))
+	}
+
+	status := runOK
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		status = runInterrupted
+	default:
+		status = runFailed
+	}
+	finished := time.Now()
+	s.history.record(run, func() {
+		run.Finished = finished
+		run.Status = status
+		if err != nil {
+			run.Error = err.Error()
+		}
+	})
+	fmt.Printf("Run of %s for %s finished: %s in %v\n", run.Tenant, run.Date, status, finished.Sub(run.Started).Round(time.Second))
+}
+
+// exec runs this program with args, prefixing its output with the tenant.
+// When ctx is done the run is interrupted as by Ctrl-C, so that it can save
+// its progress.
+func (s *scheduler) exec(ctx context.Context, tenant string, args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	output := &prefixWriter{mu: &s.output, w: os.Stdout, prefix: "[" + tenant + "] "}
+	defer output.Flush()
+
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = time.Minute
+	return cmd.Run()
+}
+
+// runDate returns the day fetched by a run scheduled at t as YYYYMMDD
+func runDate(t time.Time) string {
+	return runDay(t).Format("20060102")
+}
+
+// runDay returns the day fetched by a run scheduled at t: the last UTC day
+// complete at t, since -date reads days in UTC. Early in the day east of UTC
+// that is two days before the date of t in the schedule's time zone.
+func runDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day()-1, 0, 0, 0, 0, time.UTC)
+}
+
+// runOutputFile returns the output file of the run of tenant for day, from
+// the -out, -format and -compress options in args
+func runOutputFile(args []string, tenant string, day time.Time) string {
+	format, ok := flagValue(args, "format")
+	if !ok {
+		format = "csv"
+	}
+	compress, _ := flagValue(args, "compress")
+	ext := cloudsecure.FormatExtension(format) + cloudsecure.CompressionExtension(compress)
+	outputFile, _ := flagValue(args, "out")
+	if outputFile != "" && compress != "" && !strings.HasSuffix(outputFile, cloudsecure.CompressionExtension(compress)) {
+		outputFile += cloudsecure.CompressionExtension(compress)
+	}
+	return outputFileFor(outputFile, tenant, ext, day, true)
+}
+
+// flagValue returns the value of the string flag name in args
+func flagValue(args []string, name string) (string, bool) {
+	value, found := "", false
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		switch {
+		case arg == name && i+1 < len(args):
+			value, found = args[i+1], true
+			i++
+		case strings.HasPrefix(arg, name+"="):
+			value, found = strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return value, found
+}
+
+// withoutFlag returns args without the string flag name and its value
+func withoutFlag(args []string, name string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		switch {
+		case !strings.HasPrefix(args[i], "-"):
+			rest = append(rest, args[i])
+		case arg == name:
+			i++
+		case strings.HasPrefix(arg, name+"="):
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest
+}
+
+// prefixWriter writes every line to w starting with prefix. Lines of
+// writers sharing mu are not mixed up.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes a last line without a newline
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	io.WriteString(p.w, p.prefix+strings.TrimRight(string(line), "\r\n")+"\n")
+}
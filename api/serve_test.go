@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestRunDay(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		scheduled time.Time
+		want      string
+	}{
+		{time.Date(2026, 10, 16, 2, 0, 0, 0, time.UTC), "20261015"},
+		{time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), "20261015"},
+		{time.Date(2026, 10, 15, 23, 59, 0, 0, time.UTC), "20261014"},
+		// 02:00 in Tokyo is 17:00 UTC the day before, which is not over yet
+		{time.Date(2026, 10, 16, 2, 0, 0, 0, tokyo), "20261014"},
+		{time.Date(2026, 10, 16, 10, 0, 0, 0, tokyo), "20261015"},
+		{time.Date(2026, 3, 1, 1, 0, 0, 0, tokyo), "20260227"},
+		// 23:00 in New York is already the next day in UTC
+		{time.Date(2026, 10, 16, 23, 0, 0, 0, newYork), "20261016"},
+		{time.Date(2026, 10, 16, 2, 0, 0, 0, newYork), "20261015"},
+		// times read back from the run history carry a fixed offset only
+		{time.Date(2026, 10, 16, 2, 0, 0, 0, time.FixedZone("", 9*3600)), "20261014"},
+	}
+	for _, tt := range tests {
+		if got := runDate(tt.scheduled); got != tt.want {
+			t.Errorf("runDate(%v) = %s, want %s", tt.scheduled, got, tt.want)
+		}
+	}
+}
+
+func TestUnfinishedRuns(t *testing.T) {
+	history := &runHistory{Runs: []*runRecord{
+		{Tenant: "t1", Date: "20261010", Status: runFailed},
+		{Tenant: "t1", Date: "20261011", Status: runInterrupted},
+		{Tenant: "t1", Date: "20261010", Status: runOK},
+		{Tenant: "t1", Date: "20261012", Status: runOK},
+		{Tenant: "t1", Date: "20261012", Status: runSkipped},
+		{Tenant: "t2", Date: "20261013", Status: runFailed},
+		{Tenant: "t1", Date: "20261013", Status: runFailed},
+		{Tenant: "t1", Date: "20261014", Status: runInterrupted},
+	}}
+
+	var got []string
+	for _, run := range history.unfinished("t1", 3) {
+		got = append(got, run.Date)
+	}
+	// 20261010 was fetched by a later run
+	if want := []string{"20261011", "20261013", "20261014"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unfinished = %v, want %v", got, want)
+	}
+	if runs := history.unfinished("t1", 2); len(runs) != 2 || runs[0].Date != "20261013" {
+		t.Errorf("unfinished with a maximum of 2 = %v, want the 2 latest", runs)
+	}
+	if runs := history.unfinished("t1", 0); len(runs) != 0 {
+		t.Errorf("unfinished with a maximum of 0 = %v", runs)
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -65,7 +69,11 @@ func loadIPs(filename string) ([]net.IPNet, error) {
 			if ip == nil {
 				return nil, fmt.Errorf("invalid IP or CIDR: %s", ipOrCIDR)
 			}
-			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+			if ip.To4() != nil {
+				ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+			} else {
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
 		}
 		ipNets = append(ipNets, *ipNet)
 	}
@@ -100,6 +108,7 @@ func isPublicIP(ip string) bool {
 	privateIPBlocks := []string{
 		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
 		"127.0.0.0/8", "224.0.0.0/4", "255.255.255.255/32",
+		"fc00::/7", "fe80::/10", "::1/128", "ff00::/8",
 	}
 	for _, block := range privateIPBlocks {
 		_, cidr, _ := net.ParseCIDR(block)
@@ -111,15 +120,15 @@ func isPublicIP(ip string) bool {
 }
 
 // 过滤CSV文件的函数
-func filterCSV(inputFile, outputFile string, conditions []FilterCondition, flowStatus string) error {
-	file, err := os.Open(inputFile)
+func filterCSV(inputFile, outputFile string, conditions []FilterCondition, flowStatus string, compression string) error {
+	file, err := openInput(inputFile)
 	if err != nil {
 		return fmt.Errorf("error opening input file: %v", err)
 	}
 	defer file.Close()
 
 	// Create output file
-	writer, err := os.Create(outputFile)
+	writer, err := createOutput(outputFile, compression)
 	if err != nil {
 		return fmt.Errorf("error creating output file: %v", err)
 	}
@@ -159,6 +168,12 @@ func filterCSV(inputFile, outputFile string, conditions []FilterCondition, flowS
 			break
 		}
 		if err != nil {
+			// a malformed record is skipped; anything else, such as a
+			// truncated compressed file, ends the run
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return fmt.Errorf("error reading %s: %v", inputFile, err)
+			}
 			fmt.Printf("Error reading CSV record: %v\n", err)
 			continue
 		}
@@ -208,7 +223,213 @@ func filterCSV(inputFile, outputFile string, conditions []FilterCondition, flowS
 		}
 	}
 
-	return fmt.Errorf("processed %d records, filtered %d records", recordCount, filteredCount)
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	if err := writer.Commit(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+
+	fmt.Printf("Filtering complete: processed %d records, filtered %d records\n", recordCount, filteredCount)
+	return nil
+}
+
+// 压缩格式及其扩展名
+var compressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// 打开输入文件的函数，按文件头或扩展名自动解压gzip和zstd
+func openInput(fileName string) (io.ReadCloser, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(4)
+
+	compression := ""
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		compression = "gzip"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		compression = "zstd"
+	case len(magic) < 4:
+		// too short for a header, trust the extension
+		compression = compressionOf(fileName)
+	}
+
+	switch compression {
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error reading gzip input: %v", err)
+		}
+		return &inputReader{Reader: gz, closers: []io.Closer{gz, file}}, nil
+	case "zstd":
+		if err := checkZstd(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot read zstd input: %v", err)
+		}
+		cmd := exec.Command("zstd", "-d", "-q", "-c")
+		cmd.Stdin = reader
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error starting zstd: %v", err)
+		}
+		return &inputReader{Reader: stdout, cmd: cmd, closers: []io.Closer{file}}, nil
+	}
+	return &inputReader{Reader: reader, closers: []io.Closer{file}}, nil
+}
+
+// 检查zstd命令是否在PATH中，zstd的压缩和解压都依赖它
+func checkZstd() error {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return fmt.Errorf("zstd needs the zstd command, install it (e.g. apt install zstd or brew install zstd) or put it on the PATH: %v", err)
+	}
+	return nil
+}
+
+// inputReader 读取可能被压缩的输入文件。zstd由zstd命令解压，其错误在读到结尾时返回。
+type inputReader struct {
+	io.Reader
+	cmd     *exec.Cmd
+	closers []io.Closer
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF && r.cmd != nil {
+		cmd := r.cmd
+		r.cmd = nil
+		if waitErr := cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("zstd failed: %v", waitErr)
+		}
+	}
+	return n, err
+}
+
+func (r *inputReader) Close() error {
+	if r.cmd != nil {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+		r.cmd = nil
+	}
+	for _, closer := range r.closers {
+		closer.Close()
+	}
+	return nil
+}
+
+// 创建输出文件的函数，compression为空时不压缩。
+// 输出先写入同目录下的临时文件，Commit成功后才改名为fileName，所以不会留下不完整的输出文件。
+func createOutput(fileName, compression string) (*outputWriter, error) {
+	if compression != "" && compressionExtensions[compression] == "" {
+		return nil, fmt.Errorf("unknown compression %q, expected gzip or zstd", compression)
+	}
+	file, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &outputWriter{Writer: file, file: file, name: fileName}
+	switch compression {
+	case "gzip":
+		gz := gzip.NewWriter(file)
+		w.Writer, w.compressor = gz, gz
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = file
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("error starting zstd: %v", err)
+		}
+		w.Writer, w.compressor, w.cmd = stdin, stdin, cmd
+	}
+	return w, nil
+}
+
+// outputWriter 写入可能被压缩的输出临时文件
+type outputWriter struct {
+	io.Writer
+	compressor io.Closer
+	cmd        *exec.Cmd
+	file       *os.File
+	name       string
+	closed     bool
+}
+
+// Commit 完成压缩，把临时文件写入磁盘并改名为最终文件名
+func (w *outputWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("%s already closed", w.name)
+	}
+	w.closed = true
+	err := w.finish()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err == nil {
+		err = w.file.Chmod(0644)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.name)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return err
+}
+
+// Close 在没有Commit时删除临时文件，原有的同名文件保持不变
+func (w *outputWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.finish()
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// finish 结束压缩流
+func (w *outputWriter) finish() error {
+	var err error
+	if w.compressor != nil {
+		err = w.compressor.Close()
+	}
+	if w.cmd != nil {
+		if waitErr := w.cmd.Wait(); waitErr != nil && err == nil {
+			err = fmt.Errorf("zstd failed: %v", waitErr)
+		}
+	}
+	return err
+}
+
+// 按扩展名判断压缩格式的函数
+func compressionOf(fileName string) string {
+	ext := filepath.Ext(fileName)
+	for compression, compressionExt := range compressionExtensions {
+		if ext == compressionExt {
+			return compression
+		}
+	}
+	return ""
 }
 
 // 保存预设的函数
@@ -355,12 +576,14 @@ func saveS3Configs(fileName string, configs []S3Config) error {
 	return os.WriteFile(fileName, data, 0644)
 }
 
-// 生成输出文件名的函数
-func generateOutputFileName(inputFile, presetName string) string {
+// 生成输出文件名的函数，输入的压缩扩展名被去掉，compression的扩展名被加上
+func generateOutputFileName(inputFile, presetName, compression string) string {
+	inputFile = strings.TrimSuffix(inputFile, compressionExtensions[compressionOf(inputFile)])
 	dir := filepath.Dir(inputFile)
 	fileName := filepath.Base(inputFile)
 	fileExt := filepath.Ext(fileName)
 	fileNameWithoutExt := strings.TrimSuffix(fileName, fileExt)
+	fileExt += compressionExtensions[compression]
 
 	if presetName == "" || presetName == "Select Preset" {
 		return filepath.Join(dir, fmt.Sprintf("%s_filtered%s", fileNameWithoutExt, fileExt))
@@ -388,8 +611,20 @@ func main() {
 	cliInputFile := flag.String("input", "", "Input CSV file")
 	presetName := flag.String("preset", "", "Name of the preset to use")
 	listPresets := flag.Bool("list-presets", false, "List all available presets")
+	compress := flag.String("compress", "", "Compress the output file: gzip or zstd; gzip and zstd input is read either way")
 	flag.Parse()
 
+	if *compress != "" && compressionExtensions[*compress] == "" {
+		fmt.Printf("Unknown compression %q, expected gzip or zstd\n", *compress)
+		os.Exit(1)
+	}
+	if *compress == "zstd" {
+		if err := checkZstd(); err != nil {
+			fmt.Printf("Invalid compression: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *listPresets {
 		presets, err := LoadPresets()
 		if err != nil {
@@ -424,15 +659,13 @@ func main() {
 			os.Exit(1)
 		}
 
-		outputFile := generateOutputFileName(*cliInputFile, *presetName)
-		err = filterCSV(*cliInputFile, outputFile, selectedPreset.Conditions, selectedPreset.FlowStatus)
+		outputFile := generateOutputFileName(*cliInputFile, *presetName, *compress)
+		err = filterCSV(*cliInputFile, outputFile, selectedPreset.Conditions, selectedPreset.FlowStatus, *compress)
 		if err != nil {
-			fmt.Println("Filtering complete:", err)
-			promptS3Upload(outputFile, *presetName)
-		} else {
 			fmt.Printf("Error during filtering: %v\n", err)
 			os.Exit(1)
 		}
+		promptS3Upload(outputFile, *presetName)
 		os.Exit(0)
 	}
 